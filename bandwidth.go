@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	bandwidthLimit = flag.Float64("bandwidth", 0, "所有测速连接合计的带宽上限(MB/s)，0为不限制")
+	dataBudget     = flag.Float64("data-budget", 0, "每次运行测速最多使用的流量(MB)，用完后停止测速，0为不限制")
+	speedMaxBytes  = flag.Int64("speed-max-bytes", 0, "每个IP下载测速最多下载的字节数，0为不限制")
+)
+
+var (
+	bwMu   sync.Mutex
+	bwNext time.Time // 按带宽上限，下一段数据允许读取的时间
+
+	dataUsed       int64 // 本次运行测速已使用的流量(字节)，下载和上传合计
+	budgetNotified int32 // 是否已提示流量预算用完
+	budgetSkipped  int32 // 流量预算用完后没有测速的IP数量
+)
+
+// 开始新一次运行的流量统计
+func resetDataUsage() {
+	atomic.StoreInt64(&dataUsed, 0)
+	atomic.StoreInt32(&budgetNotified, 0)
+	atomic.StoreInt32(&budgetSkipped, 0)
+}
+
+// 本次运行的流量预算是否已用完，第一次用完时打印提示
+func budgetExhausted() bool {
+	if *dataBudget <= 0 || float64(atomic.LoadInt64(&dataUsed)) < *dataBudget*1024*1024 {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&budgetNotified, 0, 1) {
+		fmt.Printf("已用完流量预算 %.0f MB，停止测速\n", *dataBudget)
+	}
+	return true
+}
+
+// 记录传输的 n 字节，并按 -bandwidth 等待到这些数据在带宽上限内所需的时间
+// 所有测速连接共用同一个时间线，合计速度不会超过上限
+func consumeBandwidth(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&dataUsed, int64(n))
+	metricSpeedBytes.add(uint64(n))
+	if *bandwidthLimit <= 0 {
+		return
+	}
+	cost := time.Duration(float64(n) / (*bandwidthLimit * 1024 * 1024) * float64(time.Second))
+
+	bwMu.Lock()
+	now := time.Now()
+	slot := bwNext
+	if slot.Before(now) {
+		slot = now
+	}
+	bwNext = slot.Add(cost)
+	bwMu.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
+
+// 测速过程中流量预算用完，已下载的部分不足以代表该IP的速度
+var errBudgetExhausted = errors.New("流量预算已用完")
+
+// 计入流量统计和带宽上限的测速响应体，单个IP的下载量达到 -speed-max-bytes 时结束，
+// 预算用完时返回 errBudgetExhausted
+type meteredReader struct {
+	r       io.Reader
+	ipBytes *int64 // 同一IP各连接共用的下载计数
+	cut     *int32 // 同一IP任一连接因预算用完而中断时置为1
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	if budgetExhausted() {
+		atomic.StoreInt32(m.cut, 1)
+		return 0, errBudgetExhausted
+	}
+	if *speedMaxBytes > 0 {
+		left := *speedMaxBytes - atomic.LoadInt64(m.ipBytes)
+		if left <= 0 {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := m.r.Read(p)
+	atomic.AddInt64(m.ipBytes, int64(n))
+	consumeBandwidth(n)
+	return n, err
+}
+
+// 打印本次运行测速使用的流量
+func printDataUsage() {
+	used := float64(atomic.LoadInt64(&dataUsed)) / 1024 / 1024
+	if *dataBudget > 0 {
+		fmt.Printf("测速共使用流量 %.1f MB (预算 %.0f MB)\n", used, *dataBudget)
+		if n := atomic.LoadInt32(&budgetSkipped); n > 0 {
+			fmt.Printf("流量预算用完后有 %d 个IP未测速\n", n)
+		}
+	} else {
+		fmt.Printf("测速共使用流量 %.1f MB\n", used)
+	}
+}
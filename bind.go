@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 检测连接绑定的网卡或源地址
+type bindTarget struct {
+	name  string   // 用于显示和输出文件名
+	iface string   // 网卡名称，为空时只绑定源地址
+	addrs []net.IP // 可用的源地址，按目标IP的地址族选择
+}
+
+var (
+	bindInterfaces stringList
+	bindSourceIPs  stringList
+
+	bindMu       sync.Mutex
+	bindKey      string // 生成 bindList 时的参数，参数变化后重新解析
+	bindList     []bindTarget
+	bindErr      error
+	bindOverride *bindTarget // 多网卡模式下当前这一轮使用的目标
+)
+
+func init() {
+	flag.Var(&bindInterfaces, "interface", "检测连接使用的网卡，多个用逗号分隔或重复指定时依次通过每个网卡检测并并列输出结果")
+	flag.Var(&bindSourceIPs, "source-ip", "检测连接使用的源地址，多个用逗号分隔或重复指定时依次通过每个地址检测并并列输出结果")
+}
+
+// 解析 -interface 和 -source-ip，只指定一个网卡和一个源地址时合并为一个目标
+func bindTargets() ([]bindTarget, error) {
+	ifaces := splitList(bindInterfaces)
+	ips := splitList(bindSourceIPs)
+	key := strings.Join(ifaces, ",") + "|" + strings.Join(ips, ",")
+
+	bindMu.Lock()
+	defer bindMu.Unlock()
+	if key == bindKey {
+		return bindList, bindErr
+	}
+	bindKey = key
+	bindList, bindErr = parseBindTargets(ifaces, ips)
+	return bindList, bindErr
+}
+
+func parseBindTargets(ifaces, ips []string) ([]bindTarget, error) {
+	var targets []bindTarget
+	for _, name := range ifaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("网卡 %s 不存在: %v", name, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("无法获取网卡 %s 的地址: %v", name, err)
+		}
+		target := bindTarget{name: name, iface: name}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				target.addrs = append(target.addrs, ipNet.IP)
+			}
+		}
+		if len(target.addrs) == 0 {
+			return nil, fmt.Errorf("网卡 %s 没有可用的地址", name)
+		}
+		targets = append(targets, target)
+	}
+
+	var sourceTargets []bindTarget
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("源地址格式错误: %s", s)
+		}
+		sourceTargets = append(sourceTargets, bindTarget{name: ip.String(), addrs: []net.IP{ip}})
+	}
+	if len(targets) == 1 && len(sourceTargets) == 1 {
+		// 同时指定网卡和源地址: 从该网卡以指定地址发出
+		targets[0].addrs = sourceTargets[0].addrs
+		return targets, nil
+	}
+	return append(targets, sourceTargets...), nil
+}
+
+// 展开逗号分隔的多个值
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// 当前检测使用的绑定目标，未指定时为 nil
+func currentBind() *bindTarget {
+	bindMu.Lock()
+	override := bindOverride
+	bindMu.Unlock()
+	if override != nil {
+		return override
+	}
+	targets, err := bindTargets()
+	if err != nil || len(targets) == 0 {
+		return nil
+	}
+	return &targets[0]
+}
+
+// 多网卡模式下切换本轮检测使用的目标
+func setBindOverride(target *bindTarget) {
+	bindMu.Lock()
+	bindOverride = target
+	bindMu.Unlock()
+}
+
+// 多网卡模式下当前这一轮使用的目标名称，其他情况为空
+func bindOverrideName() string {
+	bindMu.Lock()
+	defer bindMu.Unlock()
+	if bindOverride == nil {
+		return ""
+	}
+	return bindOverride.name
+}
+
+// 按当前绑定目标设置拨号器的源地址和网卡，host 为要连接的IP(代理地址或候选IP)
+func bindDialer(dialer *net.Dialer, network, host string) error {
+	target := currentBind()
+	if target == nil {
+		return nil
+	}
+	if target.iface != "" {
+		dialer.Control = bindToDevice(target.iface)
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		// 代理地址是域名时无法预先确定地址族，只绑定网卡
+		return nil
+	}
+	for _, ip := range target.addrs {
+		if (ip.To4() != nil) == (remote.To4() != nil) {
+			if strings.HasPrefix(network, "udp") {
+				dialer.LocalAddr = &net.UDPAddr{IP: ip}
+			} else {
+				dialer.LocalAddr = &net.TCPAddr{IP: ip}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s 没有与 %s 相同地址族的源地址", target.name, host)
+}
+
+// 多网卡模式: 依次通过每个网卡或源地址检测同一批候选IP，各自写入结果文件，并输出并列对比
+// 每个 IP:端口 取各网卡中最好的结果合并后写入 -outfile，和单网卡时一样上传、更新DNS和发送通知
+func scanInterfaces(targets []bindTarget) error {
+	if *outFile == "-" {
+		return fmt.Errorf("多网卡模式不支持输出到标准输出")
+	}
+	startTime := time.Now()
+	increaseMaxOpenFiles()
+
+	// 同一批候选IP要检测多次，先全部读入内存
+	cands, _, err := streamCandidates()
+	if err != nil {
+		return fmt.Errorf("无法从文件中读取 IP: %v", err)
+	}
+	var ips []candidate
+	for c := range cands {
+		ips = append(ips, c)
+	}
+
+	locationMap, err := loadLocations()
+	if err != nil {
+		return err
+	}
+	defer setBindOverride(nil)
+	// 各网卡的最佳速度指标按网卡分别记录，先清除上一次运行的数据
+	resetRunMetrics()
+	// 所有网卡的失败记录写入同一个 -failfile
+	resetFailures()
+	defer closeFailures()
+
+	perTarget := make([][]speedtestresult, len(targets))
+	for i := range targets {
+		target := &targets[i]
+		fmt.Printf("=== 通过 %s 检测 %d 个IP ===\n", target.name, len(ips))
+		setBindOverride(target)
+
+		name := bindOutFile(*outFile, target.name)
+		rw := newResultWriter(name)
+		results, validCount := runScan(candidateChan(ips), len(ips), locationMap, rw.write)
+		if err := rw.close(); err != nil {
+			return fmt.Errorf("写入结果失败: %v", err)
+		}
+		if err := writeResultsCSV(name, results); err != nil {
+			return fmt.Errorf("无法创建文件: %v", err)
+		}
+		fmt.Printf("\n%s: 有效IP %d 个，结果已写入 %s\n", target.name, validCount, name)
+		if err := reportPorts(name, results); err != nil {
+			fmt.Println(err)
+		}
+		perTarget[i] = results
+	}
+	setBindOverride(nil)
+
+	compare := bindOutFile(*outFile, "compare")
+	if err := writeSideBySideCSV(compare, targets, perTarget); err != nil {
+		return fmt.Errorf("无法创建文件: %v", err)
+	}
+	fmt.Printf("各网卡结果对比已写入 %s\n", compare)
+
+	merged := mergeBestResults(perTarget)
+	if len(merged) == 0 {
+		fmt.Println("没有发现有效的IP")
+		printFailureSummary()
+		sendNotifications(buildNotifySummary(nil, 0, startTime))
+		return nil
+	}
+	return finishScan(merged, int32(len(merged)), startTime, false)
+}
+
+// 按结果好坏比较时使用的分数，越大越好: 测速时为下载速度，否则为延迟的相反数
+func resultScore(res *speedtestresult) float64 {
+	if *speedTest > 0 {
+		return res.downloadSpeed
+	}
+	return -float64(res.result.tcpDuration)
+}
+
+// 每个 IP:端口 保留各网卡中最好的一个结果，按 -sort 排序
+func mergeBestResults(perTarget [][]speedtestresult) []speedtestresult {
+	best := map[string]int{}
+	var merged []speedtestresult
+	for _, results := range perTarget {
+		for _, res := range results {
+			key := net.JoinHostPort(res.result.ip, strconv.Itoa(res.result.port))
+			if i, ok := best[key]; !ok {
+				best[key] = len(merged)
+				merged = append(merged, res)
+			} else if resultScore(&res) > resultScore(&merged[i]) {
+				merged[i] = res
+			}
+		}
+	}
+	sortResults(merged)
+	return merged
+}
+
+// 各网卡的结果文件名，如 ip.csv -> ip-eth1.csv
+func bindOutFile(name, target string) string {
+	ext := filepath.Ext(name)
+	safe := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(target)
+	return strings.TrimSuffix(name, ext) + "-" + safe + ext
+}
+
+// 按 IP:端口 并列输出各网卡的延迟和速度，只在部分网卡有效的IP对应列留空
+func writeSideBySideCSV(filename string, targets []bindTarget, perTarget [][]speedtestresult) error {
+	type row struct {
+		base  result
+		byTgt []*speedtestresult
+		best  float64 // 各网卡中最好的成绩，按它从好到差排序
+	}
+	rows := map[string]*row{}
+	var keys []string
+	for i, results := range perTarget {
+		for j := range results {
+			res := &results[j]
+			key := net.JoinHostPort(res.result.ip, strconv.Itoa(res.result.port))
+			r, ok := rows[key]
+			if !ok {
+				r = &row{base: res.result, byTgt: make([]*speedtestresult, len(targets)), best: resultScore(res)}
+				rows[key] = r
+				keys = append(keys, key)
+			}
+			r.byTgt[i] = res
+			if s := resultScore(res); s > r.best {
+				r.best = s
+			}
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return rows[keys[i]].best > rows[keys[j]].best
+	})
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+
+	header := []string{"IP地址", "端口", "数据中心", "城市(中文)"}
+	for _, target := range targets {
+		header = append(header, target.name+" 网络延迟")
+		if *speedTest > 0 {
+			header = append(header, target.name+" 下载速度(MB/s)")
+		}
+	}
+	writer.Write(header)
+	for _, key := range keys {
+		r := rows[key]
+		record := []string{r.base.ip, strconv.Itoa(r.base.port), r.base.dataCenter, r.base.city_zh}
+		for _, res := range r.byTgt {
+			latency, speed := "", ""
+			if res != nil {
+				latency, speed = res.result.latency, formatSpeedMBs(res.downloadSpeed)
+			}
+			record = append(record, latency)
+			if *speedTest > 0 {
+				record = append(record, speed)
+			}
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
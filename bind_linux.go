@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+var bindWarnOnce sync.Once
+
+// 通过 SO_BINDTODEVICE 把连接绑定到网卡，保证从该网卡发出；没有权限时只绑定源地址
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err == syscall.EPERM {
+			bindWarnOnce.Do(func() {
+				fmt.Printf("无法绑定网卡 %s(需要root或CAP_NET_RAW权限)，只绑定源地址\n", iface)
+			})
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// 其他平台没有 SO_BINDTODEVICE，只通过源地址选择网卡
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 本工具创建的DNS记录带有此备注，只有带此备注的记录才会被替换或删除
+const cfManagedComment = "managed-by-iptest"
+
+var (
+	cfAPI     = flag.String("cf-api", "https://api.cloudflare.com/client/v4", "Cloudflare API地址")
+	cfToken   = flag.String("cf-token", "", "Cloudflare API令牌(需要DNS编辑权限)")
+	cfZone    = flag.String("cf-zone", "", "Cloudflare 区域ID或域名(如 example.com)")
+	cfName    = flag.String("cf-name", "", "要更新的DNS记录名(如 best.example.com)，留空则不更新")
+	cfTop     = flag.Int("cf-top", 3, "写入DNS记录的前N个IP")
+	cfTTL     = flag.Int("cf-ttl", 1, "DNS记录TTL(秒)，1为自动")
+	cfProxied = flag.Bool("cf-proxied", false, "DNS记录是否开启Cloudflare代理")
+	cfDryRun  = flag.Bool("cf-dryrun", false, "只打印计划执行的DNS变更，不实际修改")
+)
+
+// Cloudflare API 通用响应
+type cfResponse struct {
+	Success bool            `json:"success"`
+	Errors  []cfError       `json:"errors"`
+	Result  json.RawMessage `json:"result"`
+}
+
+type cfError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// DNS记录
+type cfRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+	Comment string `json:"comment"`
+}
+
+// 用前N个结果创建或替换 A/AAAA 记录
+func updateCloudflareDNS(results []speedtestresult) error {
+	if *cfName == "" {
+		return nil
+	}
+	if *cfToken == "" || *cfZone == "" {
+		return fmt.Errorf("更新DNS需要同时指定 -cf-token 和 -cf-zone")
+	}
+
+	// 按类型整理期望的记录内容，同一IP的不同端口只保留一个
+	desired := map[string][]string{}
+	seen := map[string]bool{}
+	for _, res := range results {
+		if len(seen) >= *cfTop {
+			break
+		}
+		ip := net.ParseIP(res.result.ip)
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		recordType := "AAAA"
+		if ip.To4() != nil {
+			recordType = "A"
+		}
+		desired[recordType] = append(desired[recordType], ip.String())
+	}
+	if len(seen) == 0 {
+		fmt.Println("没有可写入DNS的IP，跳过DNS更新")
+		return nil
+	}
+
+	zoneID, err := cfZoneID(*cfZone)
+	if err != nil {
+		return err
+	}
+
+	for _, recordType := range []string{"A", "AAAA"} {
+		if err := syncCloudflareRecords(zoneID, recordType, desired[recordType]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将某一类型的记录同步为期望的IP集合
+func syncCloudflareRecords(zoneID, recordType string, ips []string) error {
+	var existing []cfRecord
+	query := url.Values{"name": {*cfName}, "type": {recordType}, "per_page": {"100"}}
+	if err := cfRequest("GET", "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &existing); err != nil {
+		return fmt.Errorf("查询DNS记录失败: %v", err)
+	}
+
+	want := map[string]bool{}
+	for _, ip := range ips {
+		want[ip] = true
+	}
+
+	present := map[string]bool{}
+	for _, record := range existing {
+		present[record.Content] = true
+		if record.Comment != cfManagedComment {
+			// 不是本工具创建的记录，保持不动
+			continue
+		}
+		if want[record.Content] {
+			if record.TTL == *cfTTL && record.Proxied == *cfProxied {
+				continue
+			}
+			fmt.Printf("更新DNS记录 %s %s %s\n", recordType, *cfName, record.Content)
+			if *cfDryRun {
+				continue
+			}
+			patch := map[string]interface{}{"ttl": *cfTTL, "proxied": *cfProxied}
+			if err := cfRequest("PATCH", "/zones/"+zoneID+"/dns_records/"+record.ID, patch, nil); err != nil {
+				return fmt.Errorf("更新DNS记录失败: %v", err)
+			}
+			continue
+		}
+		fmt.Printf("删除DNS记录 %s %s %s\n", recordType, *cfName, record.Content)
+		if *cfDryRun {
+			continue
+		}
+		if err := cfRequest("DELETE", "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+			return fmt.Errorf("删除DNS记录失败: %v", err)
+		}
+	}
+
+	for _, ip := range ips {
+		if present[ip] {
+			continue
+		}
+		fmt.Printf("创建DNS记录 %s %s %s\n", recordType, *cfName, ip)
+		if *cfDryRun {
+			continue
+		}
+		record := cfRecord{Type: recordType, Name: *cfName, Content: ip, TTL: *cfTTL, Proxied: *cfProxied, Comment: cfManagedComment}
+		if err := cfRequest("POST", "/zones/"+zoneID+"/dns_records", record, nil); err != nil {
+			return fmt.Errorf("创建DNS记录失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 区域参数为域名时查询对应的区域ID
+func cfZoneID(zone string) (string, error) {
+	if !strings.Contains(zone, ".") {
+		return zone, nil
+	}
+
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if err := cfRequest("GET", "/zones?"+url.Values{"name": {zone}}.Encode(), nil, &zones); err != nil {
+		return "", fmt.Errorf("查询区域失败: %v", err)
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("未找到区域: %s", zone)
+	}
+	return zones[0].ID, nil
+}
+
+// 调用 Cloudflare API，out 不为空时解析 result 字段
+func cfRequest(method, path string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(*cfAPI, "/")+path, body)
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+*cfToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "IPTest-Tool/1.0")
+
+	client := newManagementClient(10 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var cfResp cfResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cfResp); err != nil {
+		return fmt.Errorf("状态码: %d, 无法解析响应: %v", resp.StatusCode, err)
+	}
+	if !cfResp.Success {
+		var messages []string
+		for _, e := range cfResp.Errors {
+			messages = append(messages, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("状态码: %d, 错误: %s", resp.StatusCode, strings.Join(messages, "; "))
+	}
+	if out != nil {
+		return json.Unmarshal(cfResp.Result, out)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 内存中的 Cloudflare DNS API，只有一个区域 example.com
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records map[string]cfRecord
+	nextID  int
+	changes []string // 修改类请求，如 "POST 1.1.1.3"
+}
+
+func startFakeCloudflare(t *testing.T, records ...cfRecord) (*fakeCloudflare, string) {
+	t.Helper()
+	cf := &fakeCloudflare{records: map[string]cfRecord{}}
+	for _, record := range records {
+		cf.add(record)
+	}
+	server := httptest.NewServer(cf)
+	t.Cleanup(server.Close)
+	return cf, server.URL
+}
+
+func (cf *fakeCloudflare) add(record cfRecord) {
+	cf.nextID++
+	record.ID = "r" + strconv.Itoa(cf.nextID)
+	cf.records[record.ID] = record
+}
+
+func (cf *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	reply := func(status int, result interface{}) {
+		data, _ := json.Marshal(result)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(cfResponse{Success: status == http.StatusOK, Result: data, Errors: []cfError{}})
+	}
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(cfResponse{Errors: []cfError{{Code: 10000, Message: "Authentication error"}}})
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/zones" && r.Method == "GET":
+		if r.URL.Query().Get("name") != "example.com" {
+			reply(http.StatusOK, []interface{}{})
+			return
+		}
+		reply(http.StatusOK, []map[string]string{{"id": "zone1"}})
+	case r.URL.Path == "/zones/zone1/dns_records" && r.Method == "GET":
+		query := r.URL.Query()
+		matched := []cfRecord{}
+		for _, record := range cf.records {
+			if record.Name == query.Get("name") && record.Type == query.Get("type") {
+				matched = append(matched, record)
+			}
+		}
+		reply(http.StatusOK, matched)
+	case r.URL.Path == "/zones/zone1/dns_records" && r.Method == "POST":
+		var record cfRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		cf.add(record)
+		cf.changes = append(cf.changes, "POST "+record.Content)
+		reply(http.StatusOK, record)
+	case strings.HasPrefix(r.URL.Path, "/zones/zone1/dns_records/"):
+		id := strings.TrimPrefix(r.URL.Path, "/zones/zone1/dns_records/")
+		record, ok := cf.records[id]
+		if !ok {
+			reply(http.StatusNotFound, nil)
+			return
+		}
+		cf.changes = append(cf.changes, r.Method+" "+record.Content)
+		switch r.Method {
+		case "PATCH":
+			var patch struct {
+				TTL     int  `json:"ttl"`
+				Proxied bool `json:"proxied"`
+			}
+			json.NewDecoder(r.Body).Decode(&patch)
+			record.TTL, record.Proxied = patch.TTL, patch.Proxied
+			cf.records[id] = record
+		case "DELETE":
+			delete(cf.records, id)
+		}
+		reply(http.StatusOK, map[string]string{"id": id})
+	default:
+		reply(http.StatusNotFound, nil)
+	}
+}
+
+// 当前记录，格式为 "类型 内容 TTL"，按字母排序
+func (cf *fakeCloudflare) snapshot() []string {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	var list []string
+	for _, record := range cf.records {
+		list = append(list, record.Type+" "+record.Content+" "+strconv.Itoa(record.TTL))
+	}
+	sort.Strings(list)
+	return list
+}
+
+func dnsTestResults(lines ...string) []speedtestresult {
+	var results []speedtestresult
+	for _, line := range lines {
+		ip, port, _ := parseIPLineForUpload(line)
+		results = append(results, speedtestresult{result: result{ip: ip, port: port}})
+	}
+	return results
+}
+
+func TestCloudflareDNSSync(t *testing.T) {
+	managed := func(recordType, content string, ttl int) cfRecord {
+		return cfRecord{Type: recordType, Name: "best.example.com", Content: content, TTL: ttl, Comment: cfManagedComment}
+	}
+	existing := []cfRecord{
+		managed("A", "1.1.1.1", 1),                                        // 仍在前N个中，不变
+		managed("A", "1.1.1.2", 300),                                      // 仍在前N个中，TTL不同需要更新
+		managed("A", "1.1.1.9", 1),                                        // 不在前N个中，删除
+		{Type: "A", Name: "best.example.com", Content: "1.1.1.8", TTL: 1}, // 不是本工具创建的，保留
+		{Type: "A", Name: "other.example.com", Content: "1.1.1.7", TTL: 1, Comment: cfManagedComment}, // 其它记录名，不受影响
+	}
+	results := dnsTestResults("1.1.1.1:443", "1.1.1.1:8443", "1.1.1.2:443", "1.1.1.3:443", "[2606:4700::1]:443", "1.1.1.4:443")
+
+	tests := []struct {
+		name        string
+		dryRun      bool
+		wantChanges []string
+		wantRecords []string
+	}{
+		{
+			name:        "apply",
+			wantChanges: []string{"DELETE 1.1.1.9", "PATCH 1.1.1.2", "POST 1.1.1.3", "POST 2606:4700::1"},
+			wantRecords: []string{"A 1.1.1.1 1", "A 1.1.1.2 1", "A 1.1.1.3 1", "A 1.1.1.7 1", "A 1.1.1.8 1", "AAAA 2606:4700::1 1"},
+		},
+		{
+			name:        "dryrun",
+			dryRun:      true,
+			wantRecords: []string{"A 1.1.1.1 1", "A 1.1.1.2 300", "A 1.1.1.7 1", "A 1.1.1.8 1", "A 1.1.1.9 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, url := startFakeCloudflare(t, existing...)
+			setFlags(t, map[string]string{
+				"cf-api":    url,
+				"cf-token":  "test-token",
+				"cf-zone":   "example.com",
+				"cf-name":   "best.example.com",
+				"cf-top":    "4",
+				"cf-ttl":    "1",
+				"cf-dryrun": strconv.FormatBool(tt.dryRun),
+			})
+			if err := updateCloudflareDNS(results); err != nil {
+				t.Fatal(err)
+			}
+
+			cf.mu.Lock()
+			changes := append([]string{}, cf.changes...)
+			cf.mu.Unlock()
+			sort.Strings(changes)
+			if strings.Join(changes, ", ") != strings.Join(tt.wantChanges, ", ") {
+				t.Errorf("DNS变更 %q，期望 %q", changes, tt.wantChanges)
+			}
+			if got := cf.snapshot(); strings.Join(got, ", ") != strings.Join(tt.wantRecords, ", ") {
+				t.Errorf("DNS记录 %q，期望 %q", got, tt.wantRecords)
+			}
+		})
+	}
+}
+
+func TestCloudflareDNSErrors(t *testing.T) {
+	_, url := startFakeCloudflare(t)
+	results := dnsTestResults("1.1.1.1:443")
+
+	setFlags(t, map[string]string{"cf-api": url, "cf-token": "wrong", "cf-zone": "zone1", "cf-name": "best.example.com"})
+	err := updateCloudflareDNS(results)
+	if err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Errorf("令牌错误时应该返回API的错误信息，得到 %v", err)
+	}
+
+	setFlags(t, map[string]string{"cf-token": "test-token", "cf-zone": "missing.example.com"})
+	if err := updateCloudflareDNS(results); err == nil || !strings.Contains(err.Error(), "未找到区域") {
+		t.Errorf("区域不存在时应该报错，得到 %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 子命令
+type command struct {
+	name    string
+	args    string // 用法中参数部分
+	summary string
+	run     func(args []string) error
+}
+
+// 各子命令复用的全局参数分组
+var (
+	configFlagNames = []string{"config", "profile", "proxy"}
+	scanFlagNames   = []string{"file", "source", "source-cache", "outfile", "failfile", "max", "speedtest", "rate", "subnet-limit",
+		"url", "speed-duration", "speed-warmup", "speed-warmup-bytes", "speed-conns", "speed-max-bytes", "target", "bandwidth", "data-budget",
+		"uptest", "uptest-url", "uptest-duration", "uptest-threshold", "proto", "sort", "tls", "ca", "pin", "insecure", "probe-proxy", "interface", "source-ip", "ports",
+		"delay", "speedthreshold"}
+	uploadFlagNames = []string{"upload", "token", "upload-retries", "upload-batch", "upload-gzip", "upload-header", "upload-timeout", "upload-spool",
+		"upload-mode", "upload-method", "upload-format", "upload-json-key", "upload-merge-keep"}
+	reportFlagNames = []string{"notify", "notify-top", "notify-template", "telegram-api",
+		"cf-api", "cf-token", "cf-zone", "cf-name", "cf-top", "cf-ttl", "cf-proxied", "cf-dryrun"}
+)
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"scan", "[参数]", "延迟检测并按 -speedtest 下载测速，结果写入 -outfile", cmdScan},
+		{"speedtest", "[-in ip.csv] [参数]", "对已有结果文件中的IP只做下载测速(不重新检测延迟)", cmdSpeedTest},
+		{"retest", "[-in ip.csv] [参数]", "对已有结果文件中的IP重新进行完整测速", cmdRetest},
+		{"upload", "[-in 文件] [参数]", "上传结果CSV或IP列表文件", cmdUpload},
+		{"fetch", "[-api URL] [-o 文件] [参数]", "从API下载IP列表并预处理为标准格式", cmdFetch},
+		{"preprocess", "<文件>", "调用 ip_preprocess.js 将文件整理为 \"IP 端口\" 格式并去重", cmdPreprocess},
+		{"locations", "update", "重新下载 locations.json", cmdLocations},
+		{"serve", "[-listen 地址] [参数]", "启动HTTP API服务", cmdServe},
+		{"merge", "[-o 输出文件] <结果CSV>...", "合并多个结果CSV，按 IP:端口 去重并重新排序", cmdMerge},
+	}
+}
+
+// 执行命令行，返回进程退出码
+func runCommand(args []string) int {
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				cmd.run([]string{"-h"})
+				return 0
+			}
+		}
+		printUsage()
+		return 0
+	}
+
+	if cmd := findCommand(args[0]); cmd != nil {
+		if err := cmd.run(args[1:]); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	// 兼容旧用法: ./iptest -file=ip.txt ... 等同于 scan
+	if strings.HasPrefix(args[0], "-") {
+		if err := runOriginalMain(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Printf("未知命令: %s\n\n", args[0])
+	printUsage()
+	return 2
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Println("用法: iptest <命令> [参数]")
+	fmt.Println("不带任何参数运行时进入交互菜单。")
+	fmt.Println()
+	fmt.Println("命令:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Println()
+	fmt.Println("使用 \"iptest help <命令>\" 或 \"iptest <命令> -h\" 查看命令的参数。")
+}
+
+// 创建子命令的参数集合，并挂载指定分组的全局参数
+func newCommandFlagSet(name string, groups ...[]string) *flag.FlagSet {
+	cmd := findCommand(name)
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	for _, group := range append([][]string{configFlagNames}, groups...) {
+		for _, flagName := range group {
+			f := flag.Lookup(flagName)
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: iptest %s %s\n\n%s\n\n参数:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// 解析子命令参数并加载配置文件
+func parseCommandFlags(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if err := loadConfig(explicitFlags(fs)); err != nil {
+		return err
+	}
+	if err := checkFlags(); err != nil {
+		return err
+	}
+	redirectProgressOutput()
+	return nil
+}
+
+// 检查参数之间的冲突和格式，子命令、旧用法和交互式菜单在开始扫描前都要调用
+func checkFlags() error {
+	if err := checkProtocol(); err != nil {
+		return err
+	}
+	if err := checkPorts(); err != nil {
+		return err
+	}
+	if _, err := probeTLSConfig(); err != nil {
+		return err
+	}
+	if err := checkProxies(); err != nil {
+		return err
+	}
+	if _, err := bindTargets(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 命令行中显式指定的参数，不会被配置文件覆盖
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+func cmdScan(args []string) error {
+	fs := newCommandFlagSet("scan", scanFlagNames, uploadFlagNames, reportFlagNames)
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	return scanFromFile()
+}
+
+func cmdSpeedTest(args []string) error {
+	fs := newCommandFlagSet("speedtest", scanFlagNames, uploadFlagNames, reportFlagNames)
+	in := fs.String("in", "ip.csv", "已有的结果CSV文件")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if *speedTest <= 0 {
+		return fmt.Errorf("-speedtest 必须大于0")
+	}
+
+	previous, err := readResultsFromCSV(*in)
+	if err != nil {
+		return fmt.Errorf("读取结果文件失败: %v", err)
+	}
+
+	startTime := time.Now()
+	resultChan := make(chan result, len(previous))
+	for _, res := range previous {
+		resultChan <- res.result
+	}
+	close(resultChan)
+
+	results := runSpeedTests(resultChan, len(previous))
+	sortResults(results)
+	return finishScan(results, int32(len(previous)), startTime, false)
+}
+
+func cmdRetest(args []string) error {
+	fs := newCommandFlagSet("retest", scanFlagNames, uploadFlagNames, reportFlagNames)
+	in := fs.String("in", "ip.csv", "已有的结果CSV文件")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+
+	previous, err := readResultsFromCSV(*in)
+	if err != nil {
+		return fmt.Errorf("读取结果文件失败: %v", err)
+	}
+	var ips []candidate
+	for _, res := range previous {
+		ips = append(ips, candidate{ip: res.result.ip, port: res.result.port, source: res.result.source})
+	}
+	return scanAndReport(candidateChan(ips), len(ips))
+}
+
+func cmdUpload(args []string) error {
+	fs := newCommandFlagSet("upload", uploadFlagNames)
+	in := fs.String("in", "ip.csv", "要上传的文件，.csv 按结果文件读取，其它按IP列表读取")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if *uploadURL == "" {
+		return fmt.Errorf("未指定上传API地址 (-upload)")
+	}
+
+	if strings.EqualFold(filepath.Ext(*in), ".csv") {
+		results, err := readResultsFromCSV(*in)
+		if err != nil {
+			return fmt.Errorf("读取结果文件失败: %v", err)
+		}
+		return uploadResults(results, *uploadURL, *uploadToken)
+	}
+	return uploadIPListFromFile(*in, *uploadURL, *uploadToken)
+}
+
+func cmdFetch(args []string) error {
+	fs := newCommandFlagSet("fetch")
+	apiURL := fs.String("api", defaultSourceURL, "IP列表下载地址")
+	out := fs.String("o", "temp_downloaded_ips.txt", "保存的文件名")
+	preprocess := fs.Bool("preprocess", true, "下载后是否预处理为标准格式")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+
+	if err := downloadIPList(*apiURL, *out); err != nil {
+		return err
+	}
+	if !*preprocess {
+		return nil
+	}
+	processedFile, err := preprocessFile(*out)
+	if err != nil {
+		return fmt.Errorf("文件预处理失败: %v", err)
+	}
+	if processedFile != *out {
+		fmt.Printf("文件已预处理完成，输出到: %s\n", processedFile)
+	}
+	return nil
+}
+
+func cmdPreprocess(args []string) error {
+	fs := newCommandFlagSet("preprocess")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("需要指定一个输入文件")
+	}
+
+	processedFile, err := preprocessFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("文件预处理失败: %v", err)
+	}
+	fmt.Printf("输出文件: %s\n", processedFile)
+	return nil
+}
+
+func cmdLocations(args []string) error {
+	fs := newCommandFlagSet("locations")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "update" {
+		fs.Usage()
+		return fmt.Errorf("未知的 locations 子命令")
+	}
+
+	locations, err := downloadLocations()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("locations.json 已更新，共 %d 个数据中心\n", len(locations))
+	return nil
+}
+
+func cmdServe(args []string) error {
+	fs := newCommandFlagSet("serve", scanFlagNames, uploadFlagNames, reportFlagNames)
+	listen := fs.String("listen", "", "监听地址，留空时使用配置中的 serve，默认 127.0.0.1:8080")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+
+	addr := *listen
+	if addr == "" {
+		addr = *serveAddr
+	}
+	if addr == "" {
+		addr = "127.0.0.1:8080"
+	}
+	return serveAPI(addr)
+}
+
+func cmdMerge(args []string) error {
+	fs := newCommandFlagSet("merge")
+	out := fs.String("o", "merged.csv", "输出文件名, - 表示标准输出")
+	if err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	if *out == "-" {
+		os.Stdout = os.Stderr
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("需要至少一个结果CSV文件")
+	}
+
+	// 同一 IP:端口 保留速度更快(无速度时延迟更低)的一条
+	merged := map[string]speedtestresult{}
+	var order []string
+	hasSpeed := false
+	for _, filename := range fs.Args() {
+		results, err := readResultsFromCSV(filename)
+		if err != nil {
+			return fmt.Errorf("读取 %s 失败: %v", filename, err)
+		}
+		for _, res := range results {
+			if res.downloadSpeed > 0 {
+				hasSpeed = true
+			}
+			key := fmt.Sprintf("%s:%d", res.result.ip, res.result.port)
+			existing, ok := merged[key]
+			if !ok {
+				order = append(order, key)
+			}
+			if !ok || res.downloadSpeed > existing.downloadSpeed ||
+				(res.downloadSpeed == existing.downloadSpeed && res.result.tcpDuration < existing.result.tcpDuration) {
+				merged[key] = res
+			}
+		}
+	}
+
+	results := make([]speedtestresult, 0, len(order))
+	for _, key := range order {
+		results = append(results, merged[key])
+	}
+	// 输入文件都没有速度列时，输出也不带速度列
+	if !hasSpeed {
+		*speedTest = 0
+	}
+	sortResults(results)
+
+	if err := writeResultsCSV(*out, results); err != nil {
+		return fmt.Errorf("无法创建文件: %v", err)
+	}
+	fmt.Printf("已合并 %d 个文件，共 %d 个IP，写入 %s\n", fs.NArg(), len(results), *out)
+	return nil
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 配置文件支持 YAML 和 TOML 的常用子集：
+//
+//	YAML:  key: value / key: [a, b] / key: 换行后 "- 项" 列表 / profiles: 下按名称嵌套
+//	TOML:  key = value / key = ["a", "b"] / [profiles.名称] 小节
+//
+// 键名与命令行参数同名(不带 "-")，命令行显式指定的参数优先于配置文件。
+var (
+	configFile    = flag.String("config", "iptest.yaml", "配置文件路径(.yaml/.yml/.toml)，文件不存在时忽略")
+	configProfile = flag.String("profile", "", "使用配置文件中的指定配置档(如 hk-mobile)")
+
+	configLoaded bool
+)
+
+// 不保存到配置文件的参数: 配置文件本身，以及每次运行都不同的输入输出文件
+// (交互式菜单测速时 -file 指向已删除的临时文件)
+var transientFlags = map[string]bool{
+	"config":  true,
+	"profile": true,
+	"file":    true,
+	"outfile": true,
+}
+
+// 配置文件解析结果：值为 string、[]string 或 map[string]interface{}
+type configTree map[string]interface{}
+
+// 读取配置文件并应用到未在命令行中显式指定(explicit)的参数，只在第一次调用时生效
+func loadConfig(explicit map[string]bool) error {
+	if configLoaded {
+		return nil
+	}
+	configLoaded = true
+
+	if !fileExists(*configFile) {
+		if *configProfile != "" {
+			return fmt.Errorf("配置文件 %s 不存在，无法使用配置档 %s", *configFile, *configProfile)
+		}
+		return nil
+	}
+
+	tree, err := readConfigFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %v", err)
+	}
+
+	if err := applyConfigSection(tree, explicit); err != nil {
+		return err
+	}
+	if *configProfile != "" {
+		profile, ok := configProfiles(tree)[*configProfile].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("配置文件中不存在配置档: %s", *configProfile)
+		}
+		if err := applyConfigSection(profile, explicit); err != nil {
+			return fmt.Errorf("配置档 %s: %v", *configProfile, err)
+		}
+	}
+
+	if *configProfile != "" {
+		fmt.Printf("已加载配置文件 %s (配置档: %s)\n", *configFile, *configProfile)
+	} else {
+		fmt.Printf("已加载配置文件 %s\n", *configFile)
+	}
+	return nil
+}
+
+// 将一个配置小节中的键值设置到对应参数上
+func applyConfigSection(section map[string]interface{}, explicit map[string]bool) error {
+	for key, value := range section {
+		if key == "profiles" || key == "config" || key == "profile" {
+			continue
+		}
+		f := flag.Lookup(key)
+		if f == nil {
+			return fmt.Errorf("未知的配置项: %s", key)
+		}
+		if explicit[key] {
+			continue
+		}
+
+		var values []string
+		switch v := value.(type) {
+		case string:
+			values = []string{v}
+		case []string:
+			values = v
+		default:
+			return fmt.Errorf("配置项 %s 的值格式错误", key)
+		}
+
+		// 可重复参数以配置文件中的列表为准
+		if list, ok := f.Value.(*stringList); ok {
+			*list = nil
+		}
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("配置项 %s 的值无效: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func configProfiles(tree configTree) map[string]interface{} {
+	profiles, _ := tree["profiles"].(map[string]interface{})
+	return profiles
+}
+
+func isTOML(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".toml")
+}
+
+func readConfigFile(filename string) (configTree, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if isTOML(filename) {
+		return parseTOML(string(data))
+	}
+	return parseYAML(string(data))
+}
+
+// 将当前设置保存到配置文件；选择了配置档时写入该配置档，否则写入顶层
+func saveConfig() error {
+	tree := configTree{}
+	if fileExists(*configFile) {
+		existing, err := readConfigFile(*configFile)
+		if err != nil {
+			return fmt.Errorf("读取配置文件失败: %v", err)
+		}
+		tree = existing
+	}
+
+	section := map[string]interface{}(tree)
+	if *configProfile != "" {
+		profiles := configProfiles(tree)
+		if profiles == nil {
+			profiles = map[string]interface{}{}
+			tree["profiles"] = profiles
+		}
+		profile, _ := profiles[*configProfile].(map[string]interface{})
+		if profile == nil {
+			profile = map[string]interface{}{}
+			profiles[*configProfile] = profile
+		}
+		section = profile
+	}
+
+	// 只写入与上层设置(配置档的上层为顶层设置，顶层的上层为默认值)不同的参数，
+	// 已存在的键即使与上层相同也保留
+	flag.VisitAll(func(f *flag.Flag) {
+		if transientFlags[f.Name] {
+			return
+		}
+		base := f.DefValue
+		if *configProfile != "" {
+			switch v := tree[f.Name].(type) {
+			case string:
+				base = v
+			case []string:
+				base = strings.Join(v, ",")
+			}
+		}
+		_, existed := section[f.Name]
+		if list, ok := f.Value.(*stringList); ok {
+			if list.String() != base || existed {
+				section[f.Name] = append([]string{}, *list...)
+			}
+			return
+		}
+		if value := f.Value.String(); value != base || existed {
+			section[f.Name] = value
+		}
+	})
+
+	var content string
+	if isTOML(*configFile) {
+		content = formatTOML(tree)
+	} else {
+		content = formatYAML(tree)
+	}
+	// 配置中可能包含上传令牌等敏感信息
+	return ioutil.WriteFile(*configFile, []byte(content), 0600)
+}
+
+type configLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+func parseYAML(data string) (configTree, error) {
+	var lines []configLine
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	num := 0
+	for scanner.Scan() {
+		num++
+		raw := strings.TrimRight(stripComment(scanner.Text()), " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		if text == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("第 %d 行: 不支持使用Tab缩进", num)
+		}
+		lines = append(lines, configLine{num: num, indent: len(raw) - len(text), text: text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	pos := 0
+	tree, err := parseYAMLMap(lines, &pos, 0)
+	if err != nil {
+		return nil, err
+	}
+	if pos < len(lines) {
+		return nil, fmt.Errorf("第 %d 行: 缩进错误", lines[pos].num)
+	}
+	return configTree(tree), nil
+}
+
+func parseYAMLMap(lines []configLine, pos *int, indent int) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for *pos < len(lines) {
+		line := lines[*pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("第 %d 行: 缩进错误", line.num)
+		}
+		key, value, ok := strings.Cut(line.text, ":")
+		if !ok || strings.HasPrefix(line.text, "- ") {
+			return nil, fmt.Errorf("第 %d 行: 应为 \"键: 值\" 格式", line.num)
+		}
+		key = unquote(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		*pos++
+
+		switch {
+		case value != "":
+			if strings.HasPrefix(value, "[") {
+				list, err := parseInlineList(value)
+				if err != nil {
+					return nil, fmt.Errorf("第 %d 行: %v", line.num, err)
+				}
+				m[key] = list
+			} else {
+				m[key] = unquote(value)
+			}
+		case *pos < len(lines) && lines[*pos].indent >= indent && strings.HasPrefix(lines[*pos].text, "- "):
+			// 列表可以与键同级缩进，也可以更深一级
+			listIndent := lines[*pos].indent
+			var list []string
+			for *pos < len(lines) && lines[*pos].indent == listIndent && strings.HasPrefix(lines[*pos].text, "- ") {
+				list = append(list, unquote(strings.TrimSpace(strings.TrimPrefix(lines[*pos].text, "- "))))
+				*pos++
+			}
+			m[key] = list
+		case *pos < len(lines) && lines[*pos].indent > indent:
+			child, err := parseYAMLMap(lines, pos, lines[*pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = child
+		default:
+			m[key] = ""
+		}
+	}
+	return m, nil
+}
+
+func parseTOML(data string) (configTree, error) {
+	tree := configTree{}
+	section := map[string]interface{}(tree)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	num := 0
+	for scanner.Scan() {
+		num++
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			// 小节: [profiles.hk-mobile] 或 [profiles."hk-mobile"]
+			section = map[string]interface{}(tree)
+			for _, part := range splitTOMLKey(strings.Trim(text, "[]")) {
+				child, ok := section[part].(map[string]interface{})
+				if !ok {
+					child = map[string]interface{}{}
+					section[part] = child
+				}
+				section = child
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("第 %d 行: 应为 \"键 = 值\" 格式", num)
+		}
+		key = unquote(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "[") {
+			list, err := parseInlineList(value)
+			if err != nil {
+				return nil, fmt.Errorf("第 %d 行: %v", num, err)
+			}
+			section[key] = list
+		} else {
+			section[key] = unquote(value)
+		}
+	}
+	return tree, scanner.Err()
+}
+
+// 按点号拆分小节名，引号内的点号不拆分
+func splitTOMLKey(key string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '.':
+			parts = append(parts, unquote(strings.TrimSpace(key[start:i])))
+			start = i + 1
+		}
+	}
+	return append(parts, unquote(strings.TrimSpace(key[start:])))
+}
+
+// 解析行内列表 [a, "b", 'c']
+func parseInlineList(value string) ([]string, error) {
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("列表缺少 ]")
+	}
+	inner := strings.TrimSpace(value[1 : len(value)-1])
+	list := []string{}
+	for inner != "" {
+		var item string
+		if inner[0] == '"' || inner[0] == '\'' {
+			end := strings.IndexByte(inner[1:], inner[0])
+			if end < 0 {
+				return nil, fmt.Errorf("引号不匹配")
+			}
+			item = unquote(inner[:end+2])
+			inner = strings.TrimSpace(inner[end+2:])
+		} else {
+			end := strings.IndexByte(inner, ',')
+			if end < 0 {
+				end = len(inner)
+			}
+			item = strings.TrimSpace(inner[:end])
+			inner = inner[end:]
+		}
+		list = append(list, item)
+		inner = strings.TrimSpace(strings.TrimPrefix(inner, ","))
+	}
+	return list, nil
+}
+
+// 去掉行尾注释，引号内的 # 以及不在空白之后的 # (如URL中的锚点)不视为注释
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 {
+		if value[0] == '"' && value[len(value)-1] == '"' {
+			if s, err := strconv.Unquote(value); err == nil {
+				return s
+			}
+		}
+		if value[0] == '\'' && value[len(value)-1] == '\'' {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatYAML(tree configTree) string {
+	var b strings.Builder
+	writeYAMLMap(&b, tree, 0)
+	return b.String()
+}
+
+func writeYAMLMap(b *strings.Builder, m map[string]interface{}, indent int) {
+	prefix := strings.Repeat("  ", indent)
+	for _, key := range sortedKeys(m) {
+		switch v := m[key].(type) {
+		case string:
+			fmt.Fprintf(b, "%s%s: %s\n", prefix, key, formatScalar(v))
+		case []string:
+			if len(v) == 0 {
+				fmt.Fprintf(b, "%s%s: []\n", prefix, key)
+				continue
+			}
+			fmt.Fprintf(b, "%s%s:\n", prefix, key)
+			for _, item := range v {
+				fmt.Fprintf(b, "%s  - %s\n", prefix, strconv.Quote(item))
+			}
+		case map[string]interface{}:
+			fmt.Fprintf(b, "%s%s:\n", prefix, key)
+			writeYAMLMap(b, v, indent+1)
+		}
+	}
+}
+
+func formatTOML(tree configTree) string {
+	var b strings.Builder
+	writeTOMLSection(&b, tree, "")
+	return b.String()
+}
+
+// 先写出本小节的键值，再写出子小节
+func writeTOMLSection(b *strings.Builder, m map[string]interface{}, name string) {
+	var children []string
+	header := name != ""
+	for _, key := range sortedKeys(m) {
+		if _, ok := m[key].(map[string]interface{}); !ok && header {
+			// 只有子小节的小节(如 profiles)不需要单独写出小节头
+			fmt.Fprintf(b, "\n[%s]\n", name)
+			header = false
+		}
+		switch v := m[key].(type) {
+		case string:
+			fmt.Fprintf(b, "%s = %s\n", tomlKey(key), formatScalar(v))
+		case []string:
+			quoted := make([]string, len(v))
+			for i, item := range v {
+				quoted[i] = strconv.Quote(item)
+			}
+			fmt.Fprintf(b, "%s = [%s]\n", tomlKey(key), strings.Join(quoted, ", "))
+		case map[string]interface{}:
+			children = append(children, key)
+		}
+	}
+	for _, key := range children {
+		childName := tomlKey(key)
+		if name != "" {
+			childName = name + "." + childName
+		}
+		writeTOMLSection(b, m[key].(map[string]interface{}), childName)
+	}
+}
+
+// 数字和布尔值原样写出，其余加引号
+func formatScalar(value string) string {
+	if value == "true" || value == "false" {
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// 包含点号等特殊字符的键需要加引号
+func tomlKey(key string) string {
+	for _, c := range key {
+		if !(c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return strconv.Quote(key)
+		}
+	}
+	return key
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"delay: 300 # 毫秒", "delay: 300 "},
+		{"# 整行注释", ""},
+		{`token: "a#b" # 注释`, `token: "a#b" `},
+		{"token: 'a # b'", "token: 'a # b'"},
+		{"url: https://example.com/#anchor", "url: https://example.com/#anchor"},
+		{"delay = 300\t# TOML", "delay = 300\t"},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.line); got != tt.want {
+			t.Errorf("stripComment(%q) = %q，期望 %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseInlineList(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"[]", []string{}, false},
+		{"[a, b]", []string{"a", "b"}, false},
+		{`["a, b", 'c', d]`, []string{"a, b", "c", "d"}, false},
+		{`["X-Key: 1"]`, []string{"X-Key: 1"}, false},
+		{"[a, b", nil, true},
+		{`["a, b]`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseInlineList(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseInlineList(%q) 错误 = %v", tt.value, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseInlineList(%q) = %q，期望 %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    configTree
+		wantErr bool
+	}{
+		{
+			name: "标量和引号",
+			data: "---\ndelay: 300\ntoken: \"a\\tb\" # 注释\nurl: 'https://x/#y'\nempty:\n",
+			want: configTree{"delay": "300", "token": "a\tb", "url": "https://x/#y", "empty": ""},
+		},
+		{
+			name: "列表",
+			data: "notify: [webhook=http://a, \"telegram=1/2\"]\nsource:\n  - a.txt\n  - \"b.txt\"\nupload-header:\n- 'X-A: 1'\n",
+			want: configTree{
+				"notify":        []string{"webhook=http://a", "telegram=1/2"},
+				"source":        []string{"a.txt", "b.txt"},
+				"upload-header": []string{"X-A: 1"},
+			},
+		},
+		{
+			name: "配置档",
+			data: "delay: 300\nprofiles:\n  hk-mobile:\n    delay: 200\n    source: [hk.txt]\n  us:\n    tls: false\n",
+			want: configTree{
+				"delay": "300",
+				"profiles": map[string]interface{}{
+					"hk-mobile": map[string]interface{}{"delay": "200", "source": []string{"hk.txt"}},
+					"us":        map[string]interface{}{"tls": "false"},
+				},
+			},
+		},
+		{name: "Tab缩进", data: "profiles:\n\tus:\n", wantErr: true},
+		{name: "缩进错误", data: "delay: 1\n  tls: false\n", wantErr: true},
+		{name: "不是键值", data: "just text\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("错误 = %v", err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("解析结果 %#v，期望 %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    configTree
+		wantErr bool
+	}{
+		{
+			name: "标量和列表",
+			data: "delay = 300 # 注释\ntoken = \"a#b\"\nnotify = [\"webhook=http://a\", 'x']\n",
+			want: configTree{"delay": "300", "token": "a#b", "notify": []string{"webhook=http://a", "x"}},
+		},
+		{
+			name: "配置档",
+			data: "delay = 300\n\n[profiles.hk-mobile]\ndelay = 200\n\n[profiles.\"a.b\"]\ntls = false\n",
+			want: configTree{
+				"delay": "300",
+				"profiles": map[string]interface{}{
+					"hk-mobile": map[string]interface{}{"delay": "200"},
+					"a.b":       map[string]interface{}{"tls": "false"},
+				},
+			},
+		},
+		{name: "不是键值", data: "delay 300\n", wantErr: true},
+		{name: "列表不完整", data: "notify = [\"a\"\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("错误 = %v", err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("解析结果 %#v，期望 %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 保存的配置重新加载后得到相同的参数，临时的输入输出文件不保存
+func TestSaveConfigRoundTrip(t *testing.T) {
+	for _, name := range []string{"iptest.yaml", "iptest.toml"} {
+		for _, profile := range []string{"", "hk-mobile"} {
+			t.Run(name+"/"+profile, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), name)
+				setFlags(t, map[string]string{
+					"config":        path,
+					"profile":       profile,
+					"delay":         "123",
+					"token":         `a "quoted" # token`,
+					"upload-header": "X-A: 1",
+					"file":          "/tmp/已删除的临时文件.txt",
+					"outfile":       "menu.csv",
+				})
+				uploadHeaders = append(uploadHeaders, "X-B: 2")
+				if err := saveConfig(); err != nil {
+					t.Fatal(err)
+				}
+
+				tree, err := readConfigFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				section := map[string]interface{}(tree)
+				if profile != "" {
+					section, _ = configProfiles(tree)[profile].(map[string]interface{})
+				}
+				for _, key := range []string{"file", "outfile", "config", "profile"} {
+					if _, ok := section[key]; ok {
+						t.Errorf("不应保存 %s", key)
+					}
+				}
+
+				// 恢复默认值后从文件加载
+				setFlags(t, map[string]string{"delay": "300", "token": "", "upload-header": ""})
+				uploadHeaders = nil
+				loaded := configLoaded
+				configLoaded = false
+				t.Cleanup(func() { configLoaded = loaded })
+				if err := loadConfig(map[string]bool{}); err != nil {
+					t.Fatal(err)
+				}
+				if *delay != 123 || *uploadToken != `a "quoted" # token` {
+					t.Errorf("加载后 delay=%d token=%q", *delay, *uploadToken)
+				}
+				if want := []string{"X-A: 1", "X-B: 2"}; !reflect.DeepEqual([]string(uploadHeaders), want) {
+					t.Errorf("加载后 upload-header=%q，期望 %q", uploadHeaders, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 假边缘节点自签名证书的PEM文件
+var edgeCAFile string
+
+// 端到端测试在临时目录中运行，使用本地的 locations.json 和假边缘节点，不访问网络
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "iptest-e2e")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := func() int {
+		defer os.RemoveAll(dir)
+		if err := os.Chdir(dir); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		locations := `[
+	{"iata":"HKG","cca2":"HK","region":"Asia Pacific","city":"Hong Kong","region_zh":"亚太","country":"Hong Kong","city_zh":"香港","emoji":"🇭🇰"},
+	{"iata":"LAX","cca2":"US","region":"North America","city":"Los Angeles","region_zh":"北美","country":"United States","city_zh":"洛杉矶","emoji":"🇺🇸"}
+]`
+		if err := os.WriteFile("locations.json", []byte(locations), 0644); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		// 自签名证书通过 -ca 信任，TLS模式可以校验 speed.cloudflare.com
+		certPEM, err := generateEdgeCert()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if err := os.WriteFile("edge.pem", certPEM, 0644); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		edgeCAFile = filepath.Join(dir, "edge.pem")
+
+		// 子进程模式: 按环境变量中的参数运行命令行，用于检查真实的标准输出和标准错误
+		if args := os.Getenv("IPTEST_E2E_ARGS"); args != "" {
+			return runCommand(strings.Split(args, "\n"))
+		}
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+// 设置本次测试的参数，测试结束后恢复原值
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("未知参数 -%s", name)
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			// 可重复参数的 Set 是追加，直接替换整个列表
+			old := *list
+			*list = nil
+			t.Cleanup(func() { *list = old })
+		} else {
+			old := f.Value.String()
+			t.Cleanup(func() { f.Value.Set(old) })
+		}
+		if err := f.Value.Set(value); err != nil {
+			t.Fatalf("-%s=%s: %v", name, value, err)
+		}
+	}
+}
+
+// 把假边缘节点写入候选IP文件，并设置输入、输出和失败记录文件，返回输出文件路径
+func scanEdges(t *testing.T, values map[string]string, edges ...*fakeEdge) string {
+	t.Helper()
+	dir := t.TempDir()
+	var lines []string
+	for _, edge := range edges {
+		lines = append(lines, edge.line())
+	}
+	input := filepath.Join(dir, "ip.txt")
+	if err := os.WriteFile(input, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "ip.csv")
+	flags := map[string]string{
+		"file":     input,
+		"outfile":  out,
+		"failfile": filepath.Join(dir, "failed.csv"),
+		"tls":      "false",
+		"proto":    "h1",
+	}
+	for name, value := range values {
+		flags[name] = value
+	}
+	setFlags(t, flags)
+
+	if err := scanFromFile(); err != nil {
+		t.Fatalf("扫描失败: %v", err)
+	}
+	return out
+}
+
+func readResults(t *testing.T, path string) []speedtestresult {
+	t.Helper()
+	results, err := readResultsFromCSV(path)
+	if err != nil {
+		t.Fatalf("读取结果失败: %v", err)
+	}
+	return results
+}
+
+func failureCount(stage, reason string) int {
+	failMu.Lock()
+	defer failMu.Unlock()
+	return failCounts[stage+"/"+reason]
+}
+
+func TestScanParsesTraceAndClassifiesFailures(t *testing.T) {
+	hkg := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	lax := startFakeEdge(t, &fakeEdge{colo: "LAX", loc: "US"})
+	noUAG := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", noUAG: true})
+	unknown := startFakeEdge(t, &fakeEdge{colo: "ZZZ", loc: "JP"})
+	closed := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	closed.server.Close()
+
+	out := scanEdges(t, map[string]string{"speedtest": "0"}, hkg, lax, noUAG, unknown, closed)
+
+	results := readResults(t, out)
+	if len(results) != 3 {
+		t.Fatalf("有效结果 %d 个，期望 3 个", len(results))
+	}
+	byPort := map[int]speedtestresult{}
+	for _, res := range results {
+		byPort[res.result.port] = res
+	}
+	if res := byPort[hkg.port()]; res.result.dataCenter != "HKG" || res.result.city_zh != "香港" || res.result.emoji != "🇭🇰" {
+		t.Errorf("HKG 节点解析结果错误: %+v", res.result)
+	}
+	if res := byPort[lax.port()]; res.result.dataCenter != "LAX" || res.result.city_zh != "洛杉矶" {
+		t.Errorf("LAX 节点解析结果错误: %+v", res.result)
+	}
+	if res := byPort[unknown.port()]; res.result.dataCenter != "ZZZ" || res.result.city_zh != "" {
+		t.Errorf("未知数据中心不应匹配到位置信息: %+v", res.result)
+	}
+	csvData, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("127.0.0.1,%d,false,HKG,SG,", hkg.port()); !strings.Contains(string(csvData), want) {
+		t.Errorf("CSV 中没有 %q:\n%s", want, csvData)
+	}
+	for _, res := range results {
+		if !strings.HasSuffix(res.result.source, "ip.txt") {
+			t.Errorf("来源列错误: %q", res.result.source)
+		}
+	}
+
+	if n := failureCount("latency", failNoUAG); n != 1 {
+		t.Errorf("no_uag 失败 %d 个，期望 1 个", n)
+	}
+	if n := failureCount("latency", failDialRefused); n != 1 {
+		t.Errorf("dial_refused 失败 %d 个，期望 1 个", n)
+	}
+	data, err := os.ReadFile(*failFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("失败记录文件有 %d 行(含表头)，期望 3 行:\n%s", lines, data)
+	}
+}
+
+func TestTraceTimeoutIsFiltered(t *testing.T) {
+	slow := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", latency: timeout + timeout/2})
+	fast := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+
+	out := scanEdges(t, map[string]string{"speedtest": "0"}, slow, fast)
+
+	results := readResults(t, out)
+	if len(results) != 1 || results[0].result.port != fast.port() {
+		t.Fatalf("只应保留响应正常的节点，实际结果: %d 个", len(results))
+	}
+	if n := failureCount("latency", failHTTPTimeout); n != 1 {
+		t.Errorf("http_timeout 失败 %d 个，期望 1 个", n)
+	}
+}
+
+func TestSpeedTestFiltersAndSortsBySpeed(t *testing.T) {
+	const mb = 1024 * 1024
+	slow := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 1 * mb})
+	medium := startFakeEdge(t, &fakeEdge{colo: "LAX", loc: "US", throughput: 3 * mb})
+	fast := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 6 * mb})
+
+	out := scanEdges(t, map[string]string{
+		"speedtest":       "3",
+		"speedthreshold":  "2",
+		"speed-duration":  "1s",
+		"speed-warmup":    "200ms",
+		"uptest":          "true",
+		"uptest-duration": "300ms",
+	}, slow, medium, fast)
+
+	results := readResults(t, out)
+	if len(results) != 2 {
+		t.Fatalf("有效结果 %d 个，期望 2 个(低于阈值的应被过滤)", len(results))
+	}
+	if results[0].result.port != fast.port() || results[1].result.port != medium.port() {
+		t.Errorf("结果未按下载速度从高到低排序: %d, %d", results[0].result.port, results[1].result.port)
+	}
+	for i, want := range []float64{6, 3} {
+		got := results[i].downloadSpeed / 1024
+		if got < want*0.7 || got > want*1.3 {
+			t.Errorf("第 %d 个结果速度 %.2f MB/s，期望约 %.0f MB/s", i+1, got, want)
+		}
+		if len(results[i].speedSamples) == 0 || results[i].peakSpeed <= 0 || results[i].medianSpeed <= 0 {
+			t.Errorf("第 %d 个结果缺少采样统计", i+1)
+		}
+		if results[i].uploadSpeed <= 0 {
+			t.Errorf("第 %d 个结果缺少上传速度", i+1)
+		}
+	}
+	if atomic.LoadInt64(&fast.uploaded) == 0 {
+		t.Error("/__up 没有收到上传数据")
+	}
+	if n := failureCount("speedtest", failTooSlow); n != 1 {
+		t.Errorf("speed_too_slow 失败 %d 个，期望 1 个", n)
+	}
+}
+
+func TestTargetStopsSpeedTestEarly(t *testing.T) {
+	var edges []*fakeEdge
+	for i := 0; i < 4; i++ {
+		edges = append(edges, startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 4 * 1024 * 1024}))
+	}
+
+	out := scanEdges(t, map[string]string{
+		"speedtest":      "1",
+		"speedthreshold": "1",
+		"speed-duration": "300ms",
+		"speed-warmup":   "0s",
+		"target":         "2",
+	}, edges...)
+
+	if results := readResults(t, out); len(results) != 2 {
+		t.Errorf("有效结果 %d 个，期望达到 -target 后停止于 2 个", len(results))
+	}
+	tested := 0
+	for _, edge := range edges {
+		// 每个节点都会收到一次trace请求，测速过的节点还会收到下载请求
+		if atomic.LoadInt32(&edge.requests) > 1 {
+			tested++
+		}
+	}
+	if tested != 2 {
+		t.Errorf("测速了 %d 个节点，期望 2 个", tested)
+	}
+}
+
+func TestSpeedConnsRespectSubnetLimit(t *testing.T) {
+	edge := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 1024 * 1024})
+
+	start := time.Now()
+	out := scanEdges(t, map[string]string{
+		"speedtest":      "1",
+		"speedthreshold": "0",
+		"speed-duration": "500ms",
+		"speed-warmup":   "0s",
+		"speed-conns":    "2",
+		"subnet-limit":   "1",
+	}, edge)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("测速耗时 %v，测速连接不应等待自己占用的网段名额", elapsed)
+	}
+
+	results := readResults(t, out)
+	if len(results) != 1 {
+		t.Fatalf("有效结果 %d 个，期望 1 个", len(results))
+	}
+	if n := len(results[0].connSpeeds); n != 1 {
+		t.Errorf("使用了 %d 个测速连接，期望受 -subnet-limit 限制为 1 个", n)
+	}
+	if got := results[0].downloadSpeed / 1024; got > 1.5 {
+		t.Errorf("下载速度 %.2f MB/s 超过节点限速 1 MB/s", got)
+	}
+}
+
+func TestResultsAreUploaded(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	var auth string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer api.Close()
+
+	hkg := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	lax := startFakeEdge(t, &fakeEdge{colo: "LAX", loc: "US"})
+	scanEdges(t, map[string]string{
+		"speedtest":    "0",
+		"upload":       api.URL,
+		"token":        "secret",
+		"upload-spool": t.TempDir(),
+	}, hkg, lax)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(auth, "secret") {
+		t.Errorf("上传请求没有携带令牌: %q", auth)
+	}
+	want := map[string]bool{
+		fmt.Sprintf("127.0.0.1:%d#香港", hkg.port()):  true,
+		fmt.Sprintf("127.0.0.1:%d#洛杉矶", lax.port()): true,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("上传了 %d 行，期望 %d 行: %v", len(lines), len(want), lines)
+	}
+	for _, line := range lines {
+		if !want[line] {
+			t.Errorf("上传内容错误: %q", line)
+		}
+	}
+}
+
+func TestTLSAndHTTP2(t *testing.T) {
+	edge := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", tls: true, throughput: 2 * 1024 * 1024})
+
+	out := scanEdges(t, map[string]string{
+		"tls":            "true",
+		"ca":             edgeCAFile,
+		"proto":          "h2",
+		"speedtest":      "1",
+		"speedthreshold": "0",
+		"speed-duration": "300ms",
+		"speed-warmup":   "0s",
+	}, edge)
+
+	results := readResults(t, out)
+	if len(results) != 1 || results[0].downloadSpeed <= 0 {
+		t.Fatalf("TLS 节点应通过检测和测速，实际结果: %d 个", len(results))
+	}
+	if n := atomic.LoadInt32(&edge.h2); n < 2 {
+		t.Errorf("通过 HTTP/2 收到 %d 个请求，期望 trace 和下载都使用 HTTP/2", n)
+	}
+	if got := results[0].result.tls; got.version != "TLS 1.3" || got.cipher == "" || got.issuer != "fake edge" {
+		t.Errorf("TLS协商结果记录错误: %+v", got)
+	}
+}
+
+func TestTLSVerificationOptions(t *testing.T) {
+	sum := sha256.Sum256(edgeCert.Certificate[0])
+	fingerprint := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name  string
+		flags map[string]string
+		valid bool
+	}{
+		{"系统根证书", map[string]string{}, false},
+		{"额外CA", map[string]string{"ca": edgeCAFile}, true},
+		{"固定指纹", map[string]string{"pin": strings.ToUpper(fingerprint)}, true},
+		{"指纹不匹配", map[string]string{"pin": strings.Repeat("0", len(fingerprint))}, false},
+		{"跳过校验", map[string]string{"insecure": "true"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edge := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", tls: true})
+			flags := map[string]string{"tls": "true", "speedtest": "0"}
+			for name, value := range tt.flags {
+				flags[name] = value
+			}
+			out := scanEdges(t, flags, edge)
+
+			if tt.valid {
+				if results := readResults(t, out); len(results) != 1 {
+					t.Errorf("有效结果 %d 个，期望 1 个", len(results))
+				}
+			} else if n := failureCount("latency", failTLS); n != 1 {
+				t.Errorf("tls_error 失败 %d 个，期望 1 个", n)
+			}
+		})
+	}
+}
+
+func TestProbeProxy(t *testing.T) {
+	for _, scheme := range []string{"socks5", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			proxy, proxyURL := startFakeProxy(t, scheme)
+			edge := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 2 * 1024 * 1024})
+			closed := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+			closed.server.Close()
+
+			out := scanEdges(t, map[string]string{
+				"probe-proxy":    proxyURL,
+				"speedtest":      "1",
+				"speedthreshold": "0",
+				"speed-duration": "300ms",
+				"speed-warmup":   "0s",
+			}, edge, closed)
+
+			if results := readResults(t, out); len(results) != 1 || results[0].downloadSpeed <= 0 {
+				t.Fatalf("通过代理应有 1 个有效结果，实际 %d 个", len(results))
+			}
+			// trace 和下载测速各经过代理建立一次连接
+			if n := atomic.LoadInt32(&proxy.tunnels); n != 2 {
+				t.Errorf("代理转发了 %d 个连接，期望 2 个", n)
+			}
+			if scheme == "socks5" {
+				if n := failureCount("latency", failDialRefused); n != 1 {
+					t.Errorf("代理返回连接被拒绝时应记为 dial_refused，实际 %d 个", n)
+				}
+			} else if n := failureCount("latency", failDialError); n != 1 {
+				t.Errorf("代理返回502时应记为 dial_error，实际 %d 个", n)
+			}
+		})
+	}
+}
+
+func TestMultipleSourceAddressesSideBySide(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("只有 Linux 的回环网卡默认包含整个 127.0.0.0/8")
+	}
+	old := bindSourceIPs
+	bindSourceIPs = stringList{"127.0.0.1,127.0.0.2"}
+	t.Cleanup(func() { bindSourceIPs = old })
+
+	var uploads int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&uploads, 1)
+		io.WriteString(w, "ok")
+	}))
+	defer api.Close()
+
+	hkg := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	lax := startFakeEdge(t, &fakeEdge{colo: "LAX", loc: "US"})
+	other := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", noUAG: true})
+	out := scanEdges(t, map[string]string{
+		"speedtest":    "0",
+		"upload":       api.URL,
+		"upload-spool": t.TempDir(),
+	}, hkg, lax, other)
+
+	for _, source := range []string{"127.0.0.1", "127.0.0.2"} {
+		if results := readResults(t, bindOutFile(out, source)); len(results) != 2 {
+			t.Errorf("通过 %s 的有效结果 %d 个，期望 2 个", source, len(results))
+		}
+	}
+	// -outfile 为各源地址中最好的结果，和单网卡时一样上传
+	if results := readResults(t, out); len(results) != 2 {
+		t.Errorf("合并后的有效结果 %d 个，期望 2 个", len(results))
+	}
+	if n := atomic.LoadInt32(&uploads); n != 1 {
+		t.Errorf("上传了 %d 次，期望合并结果上传 1 次", n)
+	}
+
+	data, err := os.ReadFile(bindOutFile(out, "compare"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("对比文件有 %d 行，期望 3 行:\n%s", len(lines), data)
+	}
+	if want := "IP地址,端口,数据中心,城市(中文),127.0.0.1 网络延迟,127.0.0.2 网络延迟"; lines[0] != want {
+		t.Errorf("对比文件表头为 %q，期望 %q", lines[0], want)
+	}
+	for _, line := range lines[1:] {
+		if fields := strings.Split(line, ","); len(fields) != 6 || fields[4] == "" || fields[5] == "" {
+			t.Errorf("对比文件中每个源地址都应有延迟: %q", line)
+		}
+	}
+
+	// 两个源地址的失败都记录在同一个 -failfile 中
+	data, err = os.ReadFile(filepath.Join(filepath.Dir(out), "failed.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(failed) != 3 || !strings.HasSuffix(failed[0], ",网卡") ||
+		!strings.HasSuffix(failed[1], ",127.0.0.1") || !strings.HasSuffix(failed[2], ",127.0.0.2") {
+		t.Errorf("失败记录应包含每个源地址的失败:\n%s", data)
+	}
+}
+
+func TestPortSweepChoosesTLSPerPort(t *testing.T) {
+	secure := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", tls: true})
+	plain := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	// 假节点监听随机端口，测试期间把它们当作 Cloudflare 的TLS和明文端口
+	oldTLS, oldPlain := cfTLSPorts, cfPlainPorts
+	cfTLSPorts, cfPlainPorts = []int{secure.port()}, []int{plain.port(), closedPort}
+	t.Cleanup(func() { cfTLSPorts, cfPlainPorts = oldTLS, oldPlain })
+
+	// 两行是同一个IP，端口扫描时只检测一次
+	out := scanEdges(t, map[string]string{"ports": "all", "ca": edgeCAFile, "speedtest": "0"}, secure, plain)
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTLS := map[string]string{strconv.Itoa(secure.port()): "true", strconv.Itoa(plain.port()): "false"}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")[1:]
+	if len(lines) != 2 {
+		t.Fatalf("结果有 %d 行，期望TLS和明文端口各一行:\n%s", len(lines), data)
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, ",")
+		if want := wantTLS[fields[1]]; fields[2] != want {
+			t.Errorf("端口 %s 的TLS列为 %s，期望 %s", fields[1], fields[2], want)
+		}
+	}
+	if n := failureCount("latency", failDialRefused); n != 1 {
+		t.Errorf("未监听的端口应记为连接被拒绝，实际 %d 个", n)
+	}
+
+	data, err = os.ReadFile(bindOutFile(out, "ports"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(matrix) != 2 {
+		t.Fatalf("端口对比文件有 %d 行，期望 2 行:\n%s", len(matrix), data)
+	}
+	// 列顺序: IP地址,数据中心,城市(中文),可用端口数，然后是TLS端口、明文端口、未监听端口的延迟
+	row := strings.Split(matrix[1], ",")
+	if len(row) != 7 || row[3] != "2" || row[4] == "" || row[5] == "" || row[6] != "" {
+		t.Errorf("端口对比文件内容错误:\n%s", data)
+	}
+}
+
+func TestAPIScanExpandsPortsAndReplacesResults(t *testing.T) {
+	edge := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	dir := t.TempDir()
+	setFlags(t, map[string]string{
+		"outfile":   filepath.Join(dir, "ip.csv"),
+		"failfile":  filepath.Join(dir, "failed.csv"),
+		"tls":       "false",
+		"proto":     "h1",
+		"speedtest": "0",
+		"ports":     fmt.Sprintf("%d,%d", edge.port(), closedPort),
+	})
+	locationMap, err := loadLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLocations, oldResults := apiLocations, apiResults
+	apiLocations = locationMap
+	t.Cleanup(func() { apiLocations, apiResults = oldLocations, oldResults })
+
+	scan := func(body string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleScan(rec, httptest.NewRequest("POST", "/scan", strings.NewReader(body)))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("POST /scan 返回 %d: %s", rec.Code, rec.Body)
+		}
+		var resp map[string]int
+		json.NewDecoder(rec.Body).Decode(&resp)
+		deadline := time.Now().Add(10 * time.Second)
+		for currentProgress().Running {
+			if time.Now().After(deadline) {
+				t.Fatal("扫描没有结束")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return resp["candidates"]
+	}
+
+	// 请求体中的端口被 -ports 替换，每个IP检测两个端口
+	if n := scan(fmt.Sprintf("127.0.0.1 %d\n", closedPort)); n != 2 {
+		t.Errorf("候选数量为 %d，期望 2", n)
+	}
+	apiMu.Lock()
+	results := apiResults
+	apiMu.Unlock()
+	if len(results) != 1 || results[0].result.port != edge.port() {
+		t.Fatalf("-ports 展开后应有 1 个有效结果，实际 %d 个", len(results))
+	}
+
+	// 没有有效IP的扫描也会替换上一次的结果
+	setFlags(t, map[string]string{"ports": ""})
+	scan(fmt.Sprintf("127.0.0.1 %d\n", closedPort))
+	apiMu.Lock()
+	results = apiResults
+	apiMu.Unlock()
+	if len(results) != 0 {
+		t.Errorf("没有有效IP时 /results 仍有 %d 条上一次的结果", len(results))
+	}
+}
+
+func TestDataBudgetSkipsRemainingIPs(t *testing.T) {
+	setFlags(t, map[string]string{
+		"tls":            "false",
+		"proto":          "h1",
+		"speedtest":      "1",
+		"speedthreshold": "1",
+		"speed-duration": "1s",
+		"speed-warmup":   "0s",
+		"data-budget":    "0.3",
+	})
+	tooSlow := failureCount("speedtest", failTooSlow)
+	in := make(chan result, 3)
+	for i := 0; i < 3; i++ {
+		edge := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 2 * 1024 * 1024})
+		in <- result{ip: "127.0.0.1", port: edge.port()}
+	}
+	close(in)
+	var tested []speedtestresult
+	for res := range speedTestStage(in, 3) {
+		tested = append(tested, res)
+	}
+
+	// 第一个IP测速中途用完预算，截断的样本作废；其余IP跳过测速但仍计入进度
+	if len(tested) != 0 {
+		t.Errorf("预算截断的测速得到了 %d 条结果: %+v", len(tested), tested)
+	}
+	if n := failureCount("speedtest", failTooSlow) - tooSlow; n != 0 {
+		t.Errorf("预算截断的测速被记为 %d 次速度过低", n)
+	}
+	if n := atomic.LoadInt32(&budgetSkipped); n != 3 {
+		t.Errorf("预算用完后跳过了 %d 个IP，期望 3 个", n)
+	}
+	if s := currentProgress(); s.Stage != "speedtest" || s.Done != 3 {
+		t.Errorf("%s 阶段进度为 %d/%d，跳过的IP应计入测速进度", s.Stage, s.Done, s.Total)
+	}
+}
+
+func TestStreamingScanReportsSpeedTestProgress(t *testing.T) {
+	a := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 4 * 1024 * 1024})
+	b := startFakeEdge(t, &fakeEdge{colo: "LAX", loc: "US", throughput: 4 * 1024 * 1024})
+	closed := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	closed.server.Close()
+
+	scanEdges(t, map[string]string{
+		"speedtest":      "2",
+		"speedthreshold": "0",
+		"speed-duration": "200ms",
+		"speed-warmup":   "0s",
+	}, a, b, closed)
+
+	// 延迟检测结束后切换到测速阶段，总数为通过延迟检测的IP数量
+	if s := currentProgress(); s.Stage != "speedtest" || s.Total != 2 || s.Done != 2 {
+		t.Errorf("扫描结束时状态为 %s %d/%d，期望 speedtest 2/2", s.Stage, s.Done, s.Total)
+	}
+}
+
+// 在子进程中运行命令行，返回标准输出和标准错误的内容
+func runSubprocess(t *testing.T, stdin string, args ...string) (stdout, stderr string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "IPTEST_E2E_ARGS="+strings.Join(args, "\n"))
+	cmd.Stdin = strings.NewReader(stdin)
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v 运行失败: %v\n标准错误:\n%s", args, err, errBuf.String())
+	}
+	return outBuf.String(), errBuf.String()
+}
+
+func TestStdinToStdoutKeepsCSVOnStdout(t *testing.T) {
+	hkg := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG", throughput: 2 * 1024 * 1024})
+	lax := startFakeEdge(t, &fakeEdge{colo: "LAX", loc: "US", throughput: 2 * 1024 * 1024})
+	closed := startFakeEdge(t, &fakeEdge{colo: "HKG", loc: "SG"})
+	closed.server.Close()
+
+	stdout, stderr := runSubprocess(t, hkg.line()+"\n"+lax.line()+"\n"+closed.line()+"\n",
+		"scan", "-file", "-", "-outfile", "-", "-tls=false", "-proto", "h1",
+		"-speedtest", "2", "-speedthreshold", "0", "-speed-duration", "200ms", "-speed-warmup", "0s")
+
+	// 标准输出只有CSV: 表头加每个有效IP一行，每行列数与表头相同
+	records, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	if err != nil {
+		t.Fatalf("标准输出不是CSV: %v\n%s", err, stdout)
+	}
+	if len(records) != 3 || records[0][0] != csvHeader()[0] {
+		t.Fatalf("标准输出有 %d 行，期望表头和 2 条结果:\n%s", len(records), stdout)
+	}
+	ports := map[string]bool{}
+	for _, record := range records[1:] {
+		if record[0] != "127.0.0.1" {
+			t.Errorf("结果行 %v", record)
+		}
+		ports[record[1]] = true
+	}
+	if !ports[strconv.Itoa(hkg.port())] || !ports[strconv.Itoa(lax.port())] {
+		t.Errorf("标准输出缺少有效IP:\n%s", stdout)
+	}
+
+	// 进度和日志输出到标准错误
+	for _, want := range []string{"延迟检测完成", "正在测试IP 127.0.0.1 端口 " + strconv.Itoa(hkg.port()), "下载速度"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("标准错误中没有 %q:\n%s", want, stderr)
+		}
+	}
+	if strings.Contains(stdout, "\033") || strings.Contains(stdout, "\r") {
+		t.Errorf("标准输出中有进度控制字符:\n%q", stdout)
+	}
+}
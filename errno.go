@@ -0,0 +1,13 @@
+//go:build !plan9
+
+package main
+
+import "syscall"
+
+// 连接失败的原因，用于失败分类；代理报告的错误使用相同的值，与直连失败一起分类
+var (
+	errConnRefused error = syscall.ECONNREFUSED
+	errNetUnreach  error = syscall.ENETUNREACH
+	errHostUnreach error = syscall.EHOSTUNREACH
+	errConnReset   error = syscall.ECONNRESET
+)
@@ -0,0 +1,11 @@
+package main
+
+import "errors"
+
+// Plan 9 没有对应的错误码，代理报告的失败原因使用独立的错误值
+var (
+	errConnRefused = errors.New("connection refused")
+	errNetUnreach  = errors.New("network is unreachable")
+	errHostUnreach = errors.New("no route to host")
+	errConnReset   = errors.New("connection reset by peer")
+)
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var failFile = flag.String("failfile", "", "记录失败IP及失败原因的CSV文件(如 failed.csv)，留空则不记录")
+
+// 失败原因分类
+const (
+	failDialTimeout     = "dial_timeout"
+	failDialRefused     = "dial_refused"
+	failDialUnreachable = "dial_unreachable"
+	failDialError       = "dial_error"
+	failLocalResource   = "local_resource"
+	failLatency         = "latency_exceeded"
+	failTLS             = "tls_error"
+	failHTTPTimeout     = "http_timeout"
+	failConnReset       = "conn_reset"
+	failHTTPError       = "http_error"
+	failHTTPStatus      = "http_status"
+	failSlowResponse    = "slow_response"
+	failReadTimeout     = "read_timeout"
+	failReadError       = "read_error"
+	failNoUAG           = "no_uag"
+	failNoColo          = "no_colo"
+	failTooSlow         = "speed_too_slow"
+	failUploadTooSlow   = "upload_too_slow"
+	failProtocol        = "protocol_unsupported"
+	failQUICTimeout     = "quic_timeout"
+	failQUICError       = "quic_error"
+)
+
+var failDescriptions = map[string]string{
+	failDialTimeout:     "连接超时",
+	failDialRefused:     "连接被拒绝",
+	failDialUnreachable: "网络不可达",
+	failDialError:       "连接失败",
+	failLocalResource:   "本地资源不足",
+	failLatency:         "超过延迟阈值",
+	failTLS:             "TLS握手失败",
+	failHTTPTimeout:     "请求超时",
+	failConnReset:       "连接被重置",
+	failHTTPError:       "请求失败",
+	failHTTPStatus:      "状态码非2xx",
+	failSlowResponse:    "响应超过最大耗时",
+	failReadTimeout:     "读取响应超时",
+	failReadError:       "读取响应失败",
+	failNoUAG:           "响应中没有 uag=",
+	failNoColo:          "无法解析数据中心",
+	failTooSlow:         "低于速度阈值",
+	failUploadTooSlow:   "低于上传速度阈值",
+	failProtocol:        "不支持所选协议",
+	failQUICTimeout:     "QUIC无响应",
+	failQUICError:       "QUIC探测失败",
+}
+
+// 分类后的失败原因
+type probeError struct {
+	reason string
+	err    error
+}
+
+func (e *probeError) Error() string {
+	if e.err == nil {
+		return failDescriptions[e.reason]
+	}
+	return fmt.Sprintf("%s: %v", failDescriptions[e.reason], e.err)
+}
+
+func newProbeError(reason string, err error) *probeError {
+	return &probeError{reason: reason, err: err}
+}
+
+// 对建立连接的错误分类
+func classifyDialError(err error) *probeError {
+	var netErr net.Error
+	switch {
+	case isResourceExhausted(err):
+		return newProbeError(failLocalResource, err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return newProbeError(failDialTimeout, err)
+	case errors.Is(err, errConnRefused):
+		return newProbeError(failDialRefused, err)
+	case errors.Is(err, errNetUnreach), errors.Is(err, errHostUnreach):
+		return newProbeError(failDialUnreachable, err)
+	}
+	return newProbeError(failDialError, err)
+}
+
+// 对HTTP请求的错误分类
+func classifyRequestError(err error) *probeError {
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var pe *probeError
+	switch {
+	case errors.As(err, &pe):
+		return pe
+	case errors.As(err, &recordErr), errors.As(err, &certErr), strings.Contains(err.Error(), "tls: "):
+		return newProbeError(failTLS, err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return newProbeError(failHTTPTimeout, err)
+	case errors.Is(err, errConnReset):
+		return newProbeError(failConnReset, err)
+	}
+	return newProbeError(failHTTPError, err)
+}
+
+// 失败统计，键为 阶段/原因；failCounts 只统计本次运行，failTotals 自进程启动起累计
+var (
+	failMu     sync.Mutex
+	failCounts = map[string]int{}
+	failTotals = map[string]uint64{}
+	failWriter *csv.Writer
+	failOut    *os.File
+	failBind   bool // 多网卡模式下记录失败时使用的网卡或源地址
+)
+
+// 开始新一次运行的失败统计，设置了 -failfile 时创建文件
+func resetFailures() {
+	failMu.Lock()
+	defer failMu.Unlock()
+	failCounts = map[string]int{}
+	if *failFile == "" {
+		return
+	}
+	file, err := os.Create(*failFile)
+	if err != nil {
+		fmt.Printf("无法创建失败记录文件: %v\n", err)
+		return
+	}
+	failOut = file
+	failWriter = csv.NewWriter(file)
+	header := []string{"IP地址", "端口", "来源", "阶段", "原因", "详情"}
+	targets, _ := bindTargets()
+	if failBind = len(targets) > 1; failBind {
+		header = append(header, "网卡")
+	}
+	failWriter.Write(header)
+	failWriter.Flush()
+}
+
+// 记录一个候选IP的失败原因，stage 为 latency 或 speedtest
+func recordFailure(ip string, port int, source, stage string, err error) {
+	reason := failHTTPError
+	var pe *probeError
+	if errors.As(err, &pe) {
+		reason = pe.reason
+	}
+
+	failMu.Lock()
+	defer failMu.Unlock()
+	failCounts[stage+"/"+reason]++
+	failTotals[stage+"/"+reason]++
+	if failWriter != nil {
+		record := []string{ip, strconv.Itoa(port), source, stage, reason, err.Error()}
+		if failBind {
+			name := ""
+			if target := currentBind(); target != nil {
+				name = target.name
+			}
+			record = append(record, name)
+		}
+		failWriter.Write(record)
+		failWriter.Flush()
+	}
+}
+
+// 关闭失败记录文件
+func closeFailures() {
+	failMu.Lock()
+	defer failMu.Unlock()
+	if failOut != nil {
+		failOut.Close()
+	}
+	failOut = nil
+	failWriter = nil
+}
+
+// 打印本次运行的失败原因统计
+func printFailureSummary() {
+	failMu.Lock()
+	defer failMu.Unlock()
+	if len(failCounts) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(failCounts))
+	total, most := 0, 0
+	for key, n := range failCounts {
+		keys = append(keys, key)
+		total += n
+		if n > most {
+			most = n
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if failCounts[keys[i]] != failCounts[keys[j]] {
+			return failCounts[keys[i]] > failCounts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Printf("失败原因统计 (共 %d 个):\n", total)
+	for _, key := range keys {
+		stage, reason, _ := strings.Cut(key, "/")
+		label := failDescriptions[reason]
+		if stage == "speedtest" {
+			label = "[测速] " + label
+		}
+		n := failCounts[key]
+		bar := strings.Repeat("#", (n*30+most-1)/most)
+		fmt.Printf("  %-18s %7d %5.1f%% %-30s %s\n", reason, n, float64(n)*100/float64(total), bar, label)
+	}
+	if *failFile != "" {
+		fmt.Printf("失败明细已写入 %s\n", *failFile)
+	}
+}
+
+// 输出按阶段和原因分类的失败计数
+func writeFailureMetrics(w io.Writer) {
+	failMu.Lock()
+	defer failMu.Unlock()
+	fmt.Fprintf(w, "# HELP iptest_failures_total 按阶段和原因分类的失败次数\n# TYPE iptest_failures_total counter\n")
+	keys := make([]string, 0, len(failTotals))
+	for key := range failTotals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		stage, reason, _ := strings.Cut(key, "/")
+		fmt.Fprintf(w, "iptest_failures_total{stage=%q,reason=%q} %d\n", stage, reason, failTotals[key])
+	}
+}
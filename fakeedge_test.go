@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的假 Cloudflare 边缘节点，只监听回环地址
+// 提供 /cdn-cgi/trace、/__down 和 /__up，每个实例相当于一个候选IP:端口
+type fakeEdge struct {
+	colo       string        // trace 返回的数据中心
+	loc        string        // trace 返回的源IP位置
+	throughput int           // /__down 每秒发送的字节数，0为不限速
+	latency    time.Duration // 每个请求在响应前等待的时间
+	noUAG      bool          // trace 中不返回 uag=，模拟非 Cloudflare 的服务
+	tls        bool          // 使用自签名证书启用TLS(支持 h2)
+
+	server   *httptest.Server
+	requests int32 // 收到的请求数
+	h2       int32 // 通过 HTTP/2 收到的请求数
+	uploaded int64 // /__up 收到的字节数
+}
+
+// 启动假边缘节点，测试结束时自动关闭
+func startFakeEdge(t *testing.T, edge *fakeEdge) *fakeEdge {
+	t.Helper()
+	edge.server = httptest.NewUnstartedServer(edge)
+	if edge.tls {
+		edge.server.TLS = &tls.Config{Certificates: []tls.Certificate{edgeCert}}
+		edge.server.EnableHTTP2 = true
+		edge.server.StartTLS()
+	} else {
+		edge.server.Start()
+	}
+	t.Cleanup(edge.server.Close)
+	return edge
+}
+
+// 候选IP文件中的一行: "IP 端口"
+func (e *fakeEdge) line() string {
+	return fmt.Sprintf("127.0.0.1 %d", e.port())
+}
+
+func (e *fakeEdge) port() int {
+	return e.server.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func (e *fakeEdge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&e.requests, 1)
+	if r.ProtoMajor == 2 {
+		atomic.AddInt32(&e.h2, 1)
+	}
+	if e.latency > 0 {
+		time.Sleep(e.latency)
+	}
+
+	switch r.URL.Path {
+	case "/cdn-cgi/trace":
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprintf(w, "fl=1f1\nh=%s\nip=%s\nts=%d\nvisit_scheme=http\n", r.Host, host, time.Now().Unix())
+		if !e.noUAG {
+			fmt.Fprintf(w, "uag=%s\n", r.UserAgent())
+		}
+		fmt.Fprintf(w, "colo=%s\nsliver=none\nhttp=http/1.1\nloc=%s\ntls=off\nsni=off\nwarp=off\ngateway=off\n", e.colo, e.loc)
+	case "/__down":
+		size, _ := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		if size <= 0 {
+			size = 100 * 1024 * 1024
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		e.writeThrottled(w, size)
+	case "/__up":
+		n, _ := io.Copy(io.Discard, r.Body)
+		atomic.AddInt64(&e.uploaded, n)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// 按 throughput 每10毫秒发送一块数据，客户端断开时结束
+func (e *fakeEdge) writeThrottled(w http.ResponseWriter, size int64) {
+	const tick = 10 * time.Millisecond
+	chunk := int64(64 * 1024)
+	if e.throughput > 0 {
+		chunk = int64(e.throughput) / int64(time.Second/tick)
+	}
+	buf := make([]byte, chunk)
+	flusher, _ := w.(http.Flusher)
+	for sent := int64(0); sent < size; sent += chunk {
+		if size-sent < chunk {
+			buf = buf[:size-sent]
+		}
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if e.throughput > 0 {
+			time.Sleep(tick)
+		}
+	}
+}
+
+// 假边缘节点共用的自签名证书，签发给 speed.cloudflare.com
+var edgeCert tls.Certificate
+
+// 生成自签名证书，返回PEM编码的证书(用作信任的根证书)
+func generateEdgeCert() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake edge"},
+		DNSNames:              []string{"speed.cloudflare.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	edgeCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// 测试用的代理，支持 SOCKS5(无认证) 和 HTTP CONNECT，记录转发的连接数
+type fakeProxy struct {
+	listener net.Listener
+	tunnels  int32
+}
+
+// 启动代理，scheme 为 socks5 或 http，返回代理地址
+func startFakeProxy(t *testing.T, scheme string) (*fakeProxy, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &fakeProxy{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.serve(conn, scheme)
+		}
+	}()
+	return proxy, scheme + "://" + listener.Addr().String()
+}
+
+func (p *fakeProxy) serve(conn net.Conn, scheme string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var target string
+	if scheme == "http" {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+		target = req.Host
+	} else {
+		// 问候: VER NMETHODS METHODS，只接受无认证
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(br, head); err != nil {
+			return
+		}
+		io.ReadFull(br, make([]byte, head[1]))
+		conn.Write([]byte{0x05, 0x00})
+		// 请求: VER CMD RSV ATYP(只支持IPv4) DST.ADDR DST.PORT
+		req := make([]byte, 10)
+		if _, err := io.ReadFull(br, req); err != nil || req[3] != 0x01 {
+			return
+		}
+		target = net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(req[8])<<8|int(req[9])))
+	}
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		if scheme == "http" {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		} else {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		}
+		return
+	}
+	defer upstream.Close()
+	atomic.AddInt32(&p.tunnels, 1)
+	if scheme == "http" {
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	} else {
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	}
+	go io.Copy(upstream, br)
+	io.Copy(conn, upstream)
+}
@@ -0,0 +1,3 @@
+module iptest
+
+go 1.20
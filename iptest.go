@@ -3,8 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -15,7 +17,6 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,19 +30,22 @@ const (
 	requestURL  = "speed.cloudflare.com/cdn-cgi/trace" // 请求trace URL
 	timeout     = 1 * time.Second                      // 超时时间
 	maxDuration = 2 * time.Second                      // 最大持续时间
+
+	defaultSourceURL = "https://zip.cm.edu.kg/all.txt" // 默认IP列表下载地址
 )
 
 var (
-	File         = flag.String("file", "ip.txt", "IP地址文件名称,格式为 ip port ,就是IP和端口之间用空格隔开")       // IP地址文件名称
-	outFile      = flag.String("outfile", "ip.csv", "输出文件名称")                                  // 输出文件名称
-	maxThreads   = flag.Int("max", 100, "并发请求最大协程数")                                           // 最大协程数
-	speedTest    = flag.Int("speedtest", 5, "下载测速协程数量,设为0禁用测速")                                // 下载测速协程数量
+	File         = flag.String("file", "ip.txt", "IP地址文件名称,格式为 ip port ,就是IP和端口之间用空格隔开, - 表示标准输入")       // IP地址文件名称
+	outFile      = flag.String("outfile", "ip.csv", "输出文件名称, - 表示标准输出")                                  // 输出文件名称
+	maxThreads   = flag.Int("max", 100, "延迟检测并发数")                                           // 最大协程数
+	speedTest    = flag.Int("speedtest", 5, "下载测速并发数(与 -max 相互独立),设为0禁用测速")                                // 下载测速协程数量
 	speedTestURL = flag.String("url", "speed.cloudflare.com/__down?bytes=500000000", "测速文件地址") // 测速文件地址
 	enableTLS    = flag.Bool("tls", true, "是否启用TLS")                                           // TLS是否启用
 	delay        = flag.Int("delay", 300, "延迟阈值(ms)，默认300ms，设为0禁用延迟过滤")                   // 延迟阈值
 	speedThreshold = flag.Float64("speedthreshold", 3.0, "速度阈值(MB/s)，默认3.0MB/s，设为0禁用速度过滤") // 速度阈值
 	uploadURL    = flag.String("upload", "", "上传API地址，留空则不上传")                              // 上传API地址
 	uploadToken  = flag.String("token", "", "上传API认证令牌")                                      // 上传API令牌
+	serveAddr    = flag.String("serve", "", "HTTP API监听地址(如 127.0.0.1:8080)，留空则不启动")             // HTTP API监听地址
 )
 
 type result struct {
@@ -57,11 +61,25 @@ type result struct {
 	emoji      string        // 国旗
 	latency     string        // 延迟
 	tcpDuration time.Duration // TCP请求延迟
+	source      string        // 来源(文件名、URL或stdin)
+	tls         tlsDetails    // TLS协商结果，未启用TLS时为空
+}
+
+// 候选IP
+type candidate struct {
+	ip     string // IP地址
+	port   int    // 端口
+	source string // 来源
 }
 
 type speedtestresult struct {
 	result
-	downloadSpeed float64 // 下载速度
+	downloadSpeed float64   // 下载速度(KB/s)，测量期间的平均值
+	peakSpeed     float64   // 峰值速度(KB/s)
+	medianSpeed   float64   // 速度中位数(KB/s)
+	speedSamples  []float64 // 每100毫秒的速度采样(KB/s)
+	uploadSpeed   float64   // 上传速度(KB/s)，未启用上传测速时为0
+	connSpeeds    []float64 // 多连接测速时各连接的速度(KB/s)
 }
 
 type location struct {
@@ -77,27 +95,17 @@ type location struct {
 	Emoji   string  `json:"emoji"`
 }
 
-// 尝试提升文件描述符的上限
-func increaseMaxOpenFiles() {
-	fmt.Println("正在尝试提升文件描述符的上限...")
-	cmd := exec.Command("bash", "-c", "ulimit -n 10000")
-	_, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("提升文件描述符上限时出现错误: %v\n", err)
-	} else {
-		fmt.Printf("文件描述符上限已提升!\n")
-	}
-}
-
 func main() {
 	// 检查是否有命令行参数
 	if len(os.Args) > 1 {
-		// 有参数，使用命令行模式
-		runOriginalMain()
-		return
+		// 有参数，使用子命令模式
+		os.Exit(runCommand(os.Args[1:]))
 	}
 
 	// 无参数，进入交互模式
+	if err := loadConfig(nil); err != nil {
+		fmt.Println(err)
+	}
 	for {
 		showMenu()
 		choice := readInput()
@@ -131,10 +139,12 @@ func showMenu() {
 	fmt.Print("请选择模式 (1-5): ")
 }
 
+// 标准输入共用一个缓冲读取器，避免多次创建时丢失已缓冲的输入
+var stdinReader = bufio.NewReader(os.Stdin)
+
 // 读取用户输入
 func readInput() string {
-	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
+	input, _ := stdinReader.ReadString('\n')
 	return strings.TrimSpace(input)
 }
 
@@ -201,40 +211,16 @@ func downloadFromAPI() {
 	apiURL := readInput()
 
 	if apiURL == "" {
-		apiURL = "https://zip.cm.edu.kg/all.txt"
-	}
-
-	fmt.Printf("正在从 %s 下载IP列表...\n", apiURL)
-
-	resp, err := http.Get(apiURL)
-	if err != nil {
-		fmt.Printf("下载失败: %v\n", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		fmt.Printf("下载失败，状态码: %d\n", resp.StatusCode)
-		return
+		apiURL = defaultSourceURL
 	}
 
 	// 保存到临时文件
 	tempFile := "temp_downloaded_ips.txt"
-	file, err := os.Create(tempFile)
-	if err != nil {
-		fmt.Printf("创建临时文件失败: %v\n", err)
-		return
-	}
-	defer file.Close()
-
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		fmt.Printf("保存文件失败: %v\n", err)
+	if err := downloadIPList(apiURL, tempFile); err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	fmt.Printf("下载完成，保存到: %s\n", tempFile)
-
 	// 预处理下载的文件
 	processedFile, err := preprocessFile(tempFile)
 	if err != nil {
@@ -258,6 +244,35 @@ func downloadFromAPI() {
 	}
 }
 
+// 下载IP列表并保存到指定文件
+func downloadIPList(apiURL, dest string) error {
+	fmt.Printf("正在从 %s 下载IP列表...\n", apiURL)
+
+	resp, err := newManagementClient(0).Get(apiURL)
+	if err != nil {
+		return fmt.Errorf("下载失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("下载失败，状态码: %d", resp.StatusCode)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("创建文件失败: %v", err)
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, resp.Body)
+	if err != nil {
+		return fmt.Errorf("保存文件失败: %v", err)
+	}
+
+	fmt.Printf("下载完成，保存到: %s\n", dest)
+	return nil
+}
+
 // 上传结果
 func uploadResultsMenu() {
 	fmt.Println("\n=== 上传测速结果 ===")
@@ -266,8 +281,7 @@ func uploadResultsMenu() {
 	fmt.Println("3. 返回主菜单")
 	fmt.Print("请选择上传模式 (1-3): ")
 
-	var choice string
-	fmt.Scanln(&choice)
+	choice := readInput()
 
 	switch choice {
 	case "1":
@@ -376,8 +390,7 @@ func uploadIPListFile() {
 	}
 
 	fmt.Print("请选择文件编号: ")
-	var choiceStr string
-	fmt.Scanln(&choiceStr)
+	choiceStr := readInput()
 
 	choice, err := strconv.Atoi(choiceStr)
 	if err != nil || choice < 1 || choice > len(allFiles) {
@@ -424,6 +437,12 @@ func readResultsFromCSV(filename string) ([]speedtestresult, error) {
 		return nil, fmt.Errorf("文件中没有数据")
 	}
 
+	// 速度、来源等可选列按标题定位，兼容没有这些列的旧文件
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+
 	var results []speedtestresult
 	// 跳过标题行
 	for _, record := range records[1:] {
@@ -432,15 +451,20 @@ func readResultsFromCSV(filename string) ([]speedtestresult, error) {
 		}
 
 		port, _ := strconv.Atoi(record[1])
-		tcpDuration, _ := time.ParseDuration(record[11] + "ms")
-
-		var downloadSpeed float64
-		if len(record) > 12 && record[12] != "" {
-			speedStr := record[12]
-			// CSV中存储的是MB/s，转换为KB/s用于内部处理
-			if speed, err := strconv.ParseFloat(speedStr, 64); err == nil {
-				downloadSpeed = speed * 1024
+		// 延迟列格式为 "12 ms"
+		latencyStr := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(record[11]), "ms"))
+		tcpDuration, _ := time.ParseDuration(latencyStr + "ms")
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
 			}
+			return ""
+		}
+		// CSV中存储的是MB/s，转换为KB/s用于内部处理
+		speedKBs := func(name string) float64 {
+			speed, _ := strconv.ParseFloat(field(name), 64)
+			return speed * 1024
 		}
 
 		res := speedtestresult{
@@ -448,7 +472,7 @@ func readResultsFromCSV(filename string) ([]speedtestresult, error) {
 				ip:          record[0],
 				port:        port,
 				dataCenter:  record[3],
-				locCode:    record[3], // 机场代码在record[3] (如SIN)
+				locCode:    record[4],
 				region:      record[5],
 				city:        record[6],
 				region_zh:    record[7],
@@ -457,8 +481,15 @@ func readResultsFromCSV(filename string) ([]speedtestresult, error) {
 				emoji:      record[10],
 				latency:     record[11],
 				tcpDuration: tcpDuration,
+				source:      field("来源"),
+				tls:         tlsDetails{field("TLS版本"), field("加密套件"), field("证书签发者")},
 			},
-			downloadSpeed: downloadSpeed,
+			downloadSpeed: speedKBs("下载速度(MB/s)"),
+			peakSpeed:     speedKBs("峰值速度(MB/s)"),
+			medianSpeed:   speedKBs("中位速度(MB/s)"),
+			speedSamples:  parseSamples(field("速度采样(MB/s)")),
+			uploadSpeed:   speedKBs("上传速度(MB/s)"),
+			connSpeeds:    parseSamples(field("单连接速度(MB/s)")),
 		}
 		results = append(results, res)
 	}
@@ -578,11 +609,12 @@ func showSettingsMenu() {
 		fmt.Println("1. 查看当前设置")
 		fmt.Println("2. 修改延迟阈值")
 		fmt.Println("3. 修改速度阈值")
-		fmt.Println("4. 修改测速协程数")
-		fmt.Println("5. 修改并发协程数")
+		fmt.Println("4. 修改下载测速并发数")
+		fmt.Println("5. 修改延迟检测并发数")
 		fmt.Println("6. 重置为默认值")
-		fmt.Println("7. 返回主菜单")
-		fmt.Print("请选择 (1-7): ")
+		fmt.Println("7. 保存设置到配置文件")
+		fmt.Println("8. 返回主菜单")
+		fmt.Print("请选择 (1-8): ")
 
 		choice := readInput()
 
@@ -600,6 +632,8 @@ func showSettingsMenu() {
 		case "6":
 			resetToDefaults()
 		case "7":
+			saveSettings()
+		case "8":
 			return
 		default:
 			fmt.Println("无效选择，请重新输入")
@@ -622,18 +656,33 @@ func showCurrentSettings() {
 		}
 		return ""
 	}())
-	fmt.Printf("  测速协程数: %d %s\n", *speedTest, func() string {
+	fmt.Printf("  下载测速并发数: %d %s\n", *speedTest, func() string {
 		if *speedTest == 0 {
 			return "(禁用测速)"
 		}
 		return ""
 	}())
-	fmt.Printf("  并发协程数: %d\n", *maxThreads)
-	fmt.Printf("  TLS启用: %t\n", *enableTLS)
+	fmt.Printf("  延迟检测并发数: %d\n", *maxThreads)
+	if *connRate > 0 {
+		fmt.Printf("  连接速率上限: %d 个/秒\n", *connRate)
+	}
+	if *subnetLimit > 0 {
+		fmt.Printf("  单网段并发上限: %d\n", *subnetLimit)
+	}
+	if *portSweep != "" {
+		fmt.Printf("  端口扫描: %s (按端口选择TLS)\n", *portSweep)
+	} else {
+		fmt.Printf("  TLS启用: %t\n", *enableTLS)
+	}
 	fmt.Printf("  输出文件: %s\n", *outFile)
 	if *uploadURL != "" {
 		fmt.Printf("  上传API: %s\n", *uploadURL)
 	}
+	if *configProfile != "" {
+		fmt.Printf("  配置文件: %s (配置档: %s)\n", *configFile, *configProfile)
+	} else {
+		fmt.Printf("  配置文件: %s\n", *configFile)
+	}
 }
 
 // 修改延迟设置
@@ -674,10 +723,10 @@ func modifySpeedSetting() {
 	}
 }
 
-// 修改测速协程数设置
+// 修改下载测速并发数设置
 func modifySpeedTestSetting() {
-	fmt.Printf("\n当前测速协程数: %d\n", *speedTest)
-	fmt.Printf("输入新的测速协程数 (0=禁用测速): ")
+	fmt.Printf("\n当前下载测速并发数: %d\n", *speedTest)
+	fmt.Printf("输入新的下载测速并发数 (0=禁用测速): ")
 	input := readInput()
 
 	if input == "" {
@@ -687,16 +736,16 @@ func modifySpeedTestSetting() {
 
 	if newTest, err := strconv.Atoi(input); err == nil && newTest >= 0 {
 		*speedTest = newTest
-		fmt.Printf("测速协程数已更新为: %d\n", *speedTest)
+		fmt.Printf("下载测速并发数已更新为: %d\n", *speedTest)
 	} else {
 		fmt.Println("输入无效，请输入非负整数")
 	}
 }
 
-// 修改并发协程数设置
+// 修改延迟检测并发数设置
 func modifyMaxThreadsSetting() {
-	fmt.Printf("\n当前并发协程数: %d\n", *maxThreads)
-	fmt.Printf("输入新的并发协程数: ")
+	fmt.Printf("\n当前延迟检测并发数: %d\n", *maxThreads)
+	fmt.Printf("输入新的延迟检测并发数: ")
 	input := readInput()
 
 	if input == "" {
@@ -706,7 +755,7 @@ func modifyMaxThreadsSetting() {
 
 	if newThread, err := strconv.Atoi(input); err == nil && newThread > 0 {
 		*maxThreads = newThread
-		fmt.Printf("并发协程数已更新为: %d\n", *maxThreads)
+		fmt.Printf("延迟检测并发数已更新为: %d\n", *maxThreads)
 	} else {
 		fmt.Println("输入无效，请输入正整数")
 	}
@@ -718,14 +767,17 @@ func resetToDefaults() {
 	choice := strings.ToLower(readInput())
 
 	if choice == "y" || choice == "yes" {
-		*delay = 300
-		*speedThreshold = 3.0
-		*speedTest = 5
-		*maxThreads = 100
-		*enableTLS = true
-		*outFile = "ip.csv"
-		*uploadURL = ""
-		*uploadToken = ""
+		// 所有参数恢复为命令行默认值，配置文件路径和配置档保持不变
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Name == "config" || f.Name == "profile" {
+				return
+			}
+			if list, ok := f.Value.(*stringList); ok {
+				*list = nil
+				return
+			}
+			f.Value.Set(f.DefValue)
+		})
 
 		fmt.Println("所有设置已重置为默认值")
 		showCurrentSettings()
@@ -734,6 +786,19 @@ func resetToDefaults() {
 	}
 }
 
+// 保存设置到配置文件
+func saveSettings() {
+	if err := saveConfig(); err != nil {
+		fmt.Printf("保存设置失败: %v\n", err)
+		return
+	}
+	if *configProfile != "" {
+		fmt.Printf("设置已保存到 %s 的配置档 %s\n", *configFile, *configProfile)
+	} else {
+		fmt.Printf("设置已保存到 %s\n", *configFile)
+	}
+}
+
 // 使用指定文件运行测速
 func runTestWithFile(filename string) {
 	// 设置全局参数
@@ -744,73 +809,101 @@ func runTestWithFile(filename string) {
 	showCurrentSettings()
 
 	// 运行原有的main逻辑
-	runOriginalMain()
+	if err := runOriginalMain(); err != nil {
+		fmt.Println(err)
+	}
 }
 
-// 原有的main逻辑
-func runOriginalMain() {
+// 原有的main逻辑，参数检查与 scan 子命令相同
+func runOriginalMain() error {
 	flag.Parse()
-	var validCount int32 // 有效IP计数器
-
-	startTime := time.Now()
-	osType := runtime.GOOS
-	if osType == "linux" {
-		increaseMaxOpenFiles()
+	if err := loadConfig(explicitFlags(flag.CommandLine)); err != nil {
+		return err
 	}
+	if err := checkFlags(); err != nil {
+		return err
+	}
+	redirectProgressOutput()
 
-	var locations []location
-	if _, err := os.Stat("locations.json"); os.IsNotExist(err) {
-		fmt.Println("本地 locations.json 不存在\n正在从 https://locations-adw.pages.dev/ 下载 locations.json")
-		resp, err := http.Get("https://locations-adw.pages.dev/")
-		if err != nil {
-			fmt.Printf("无法从URL中获取JSON: %v\n", err)
-			return
+	// 配置了HTTP API监听地址时以守护进程方式运行
+	if *serveAddr != "" {
+		if err := serveAPI(*serveAddr); err != nil {
+			return fmt.Errorf("HTTP API 服务异常退出: %v", err)
 		}
+		return nil
+	}
 
-		defer resp.Body.Close()
+	return scanFromFile()
+}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("无法读取响应体: %v\n", err)
-			return
-		}
+// 从 -source 指定的来源(未指定时为 -file)读取候选IP并测速
+func scanFromFile() error {
+	if targets, err := bindTargets(); err != nil {
+		return err
+	} else if len(targets) > 1 {
+		return scanInterfaces(targets)
+	}
+	cands, total, err := streamCandidates()
+	if err != nil {
+		return fmt.Errorf("无法从文件中读取 IP: %v", err)
+	}
+	return scanAndReport(cands, total)
+}
 
-		err = json.Unmarshal(body, &locations)
-		if err != nil {
-			fmt.Printf("无法解析JSON: %v\n", err)
-			return
-		}
-		file, err := os.Create("locations.json")
-		if err != nil {
-			fmt.Printf("无法创建文件: %v\n", err)
-			return
-		}
-		defer file.Close()
+// 对候选IP执行完整的测速流程并输出结果，total 为候选数量(未知时为0)
+func scanAndReport(cands <-chan candidate, total int) error {
+	startTime := time.Now()
+	increaseMaxOpenFiles()
 
-		_, err = file.Write(body)
+	locationMap, err := loadLocations()
+	if err != nil {
+		return err
+	}
+
+	resetFailures()
+	defer closeFailures()
+	rw := newResultWriter(*outFile)
+	results, validCount := runScan(cands, total, locationMap, rw.write)
+	if err := rw.close(); err != nil {
+		return fmt.Errorf("写入结果失败: %v", err)
+	}
+	if validCount == 0 {
+		// 清除输出内容
+		fmt.Print("\033[2J")
+		fmt.Println("没有发现有效的IP")
+		printFailureSummary()
+		sendNotifications(buildNotifySummary(nil, 0, startTime))
+		return nil
+	}
+
+	return finishScan(results, validCount, startTime, true)
+}
+
+// 加载位置信息，本地不存在 locations.json 时从网络下载
+func loadLocations() (map[string]location, error) {
+	var locations []location
+	if _, err := os.Stat("locations.json"); os.IsNotExist(err) {
+		fmt.Println("本地 locations.json 不存在")
+		locations, err = downloadLocations()
 		if err != nil {
-			fmt.Printf("无法写入文件: %v\n", err)
-			return
+			return nil, err
 		}
 	} else {
 		fmt.Println("本地 locations.json 已存在,无需重新下载")
 		file, err := os.Open("locations.json")
 		if err != nil {
-			fmt.Printf("无法打开文件: %v\n", err)
-			return
+			return nil, fmt.Errorf("无法打开文件: %v", err)
 		}
 		defer file.Close()
 
 		body, err := ioutil.ReadAll(file)
 		if err != nil {
-			fmt.Printf("无法读取文件: %v\n", err)
-			return
+			return nil, fmt.Errorf("无法读取文件: %v", err)
 		}
 
 		err = json.Unmarshal(body, &locations)
 		if err != nil {
-			fmt.Printf("无法解析JSON: %v\n", err)
-			return
+			return nil, fmt.Errorf("无法解析JSON: %v", err)
 		}
 	}
 
@@ -818,196 +911,354 @@ func runOriginalMain() {
 	for _, loc := range locations {
 		locationMap[loc.Iata] = loc
 	}
+	return locationMap, nil
+}
 
-	ips, err := readIPs(*File)
+// 下载 locations.json 并保存到本地
+func downloadLocations() ([]location, error) {
+	fmt.Println("正在从 https://locations-adw.pages.dev/ 下载 locations.json")
+	resp, err := newManagementClient(0).Get("https://locations-adw.pages.dev/")
 	if err != nil {
-		fmt.Printf("无法从文件中读取 IP: %v\n", err)
-		return
+		return nil, fmt.Errorf("无法从URL中获取JSON: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取响应体: %v", err)
+	}
+
+	var locations []location
+	err = json.Unmarshal(body, &locations)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析JSON: %v", err)
 	}
+	file, err := os.Create("locations.json")
+	if err != nil {
+		return nil, fmt.Errorf("无法创建文件: %v", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(body)
+	if err != nil {
+		return nil, fmt.Errorf("无法写入文件: %v", err)
+	}
+	return locations, nil
+}
+
+// 对候选IP进行延迟检测和下载测速，返回排序后的结果和有效IP数量
+// 失败记录由调用方通过 resetFailures/closeFailures 打开和关闭，多轮检测可以写入同一个文件
+func runScan(cands <-chan candidate, total int, locationMap map[string]location, sink func(speedtestresult)) ([]speedtestresult, int32) {
+	var validCount int32 // 有效IP计数器
+	scanStart := time.Now()
+
+	// 读取、延迟检测、下载测速、写入各阶段通过有界通道相连，阶段之间的缓冲与输入规模无关
+	latencyChan := make(chan result, *maxThreads)
+
+	var count int32
+	startProgress("latency", total)
 
 	var wg sync.WaitGroup
-	wg.Add(len(ips))
-
-	resultChan := make(chan result, len(ips))
-
-	thread := make(chan struct{}, *maxThreads)
-
-	var count int
-	total := len(ips)
-
-	for _, ip := range ips {
-		thread <- struct{}{}
-		go func(ip string) {
-			defer func() {
-				<-thread
-				wg.Done()
-				count++
-				percentage := float64(count) / float64(total) * 100
-				fmt.Printf("已完成: %d 总数: %d 已完成: %.2f%%\r", count, total, percentage)
-				if count == total {
-					fmt.Printf("已完成: %d 总数: %d 已完成: %.2f%%\n", count, total, percentage)
+	for i := 0; i < *maxThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range cands {
+				if res, err := probeCandidate(c, locationMap); err != nil {
+					recordFailure(c.ip, c.port, c.source, "latency", err)
+				} else {
+					// 记录通过延迟检查的有效IP
+					valid := atomic.AddInt32(&validCount, 1)
+					updateProgress(func(s *scanStatus) { s.Valid = int(valid) })
+					latencyChan <- res
 				}
-			}()
 
-			parts := strings.Fields(ip)
-			if len(parts) != 2 {
-				fmt.Printf("IP地址格式错误: %s\n", ip)
-				return
+				done := atomic.AddInt32(&count, 1)
+				updateProgress(func(s *scanStatus) {
+					if s.Stage == "latency" {
+						s.Done = int(done)
+					}
+				})
+				if total > 0 {
+					fmt.Printf("已完成: %d 总数: %d 已完成: %.2f%%\r", done, total, float64(done)/float64(total)*100)
+				} else {
+					fmt.Printf("已完成: %d\r", done)
+				}
 			}
-			ipAddr := parts[0]
-			portStr := parts[1]
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(latencyChan)
+		fmt.Printf("延迟检测完成: %d 个候选IP，有效 %d 个\n", atomic.LoadInt32(&count), atomic.LoadInt32(&validCount))
+	}()
 
-			port, err := strconv.Atoi(portStr)
-			if err != nil {
-				fmt.Printf("端口格式错误: %s\n", portStr)
-				return
+	var testedChan <-chan speedtestresult
+	if *speedTest > 0 {
+		testedChan = speedTestStage(latencyChan, 0)
+	} else {
+		ch := make(chan speedtestresult, *maxThreads)
+		go func() {
+			defer close(ch)
+			for res := range latencyChan {
+				ch <- speedtestresult{result: res}
 			}
+		}()
+		testedChan = ch
+	}
 
-			dialer := &net.Dialer{
-				Timeout:   timeout,
-				KeepAlive: 0,
-			}
-			start := time.Now()
-			conn, err := dialer.Dial("tcp", net.JoinHostPort(ipAddr, strconv.Itoa(port)))
-			if err != nil {
-				return
-			}
-			defer conn.Close()
+	// 写入阶段: 结果到达时立即交给 sink，排序只针对通过过滤的有效结果
+	var results []speedtestresult
+	for res := range testedChan {
+		results = append(results, res)
+		if sink != nil {
+			sink(res)
+		}
+	}
 
-			tcpDuration := time.Since(start)
-			if *delay > 0 && tcpDuration.Milliseconds() > int64(*delay) {
-				return // 超过延迟阈值直接返回（仅在delay>0时生效）
-			}
+	sortResults(results)
+	recordRunMetrics(results, time.Since(scanStart))
+	return results, atomic.LoadInt32(&validCount)
+}
 
-			start = time.Now()
+// 对单个候选IP进行延迟检测(h3 模式为QUIC，否则为TCP)并请求trace获取数据中心，失败时返回分类后的原因
+func probeCandidate(c candidate, locationMap map[string]location) (result, error) {
+	ipAddr := c.ip
+	port := c.port
 
-			client := http.Client{
-				Transport: &http.Transport{
-					Dial: func(network, addr string) (net.Conn, error) {
-						return conn, nil
-					},
-				},
-				Timeout: timeout,
-			}
+	metricProbed.inc()
+	// h3 模式先通过UDP测量QUIC往返时间作为延迟，数据中心信息仍通过TCP请求trace获取
+	var quicRTT time.Duration
+	if *probeProto == "h3" {
+		rtt, err := probeQUIC(ipAddr, port)
+		if err != nil {
+			return result{}, err
+		}
+		quicRTT = rtt
+	}
 
-			var protocol string
-			if *enableTLS {
-				protocol = "https://"
-			} else {
-				protocol = "http://"
-			}
-			requestURL := protocol + requestURL
+	conn, tcpDuration, err := dialCandidate(ipAddr, port, timeout)
+	if err != nil {
+		metricDialFailures.inc()
+		return result{}, classifyDialError(err)
+	}
+	defer conn.Close()
+	if quicRTT > 0 {
+		tcpDuration = quicRTT
+	}
 
-			req, _ := http.NewRequest("GET", requestURL, nil)
+	metricTCPLatency.observe(tcpDuration.Seconds())
+	if *delay > 0 && tcpDuration.Milliseconds() > int64(*delay) {
+		metricLatencyFiltered.inc()
+		return result{}, newProbeError(failLatency, fmt.Errorf("%d ms", tcpDuration.Milliseconds())) // 超过延迟阈值直接返回（仅在delay>0时生效）
+	}
 
-			// 添加用户代理
-			req.Header.Set("User-Agent", "Mozilla/5.0")
-			req.Close = true
-			resp, err := client.Do(req)
-			if err != nil {
-				return
-			}
+	// 后续任一步骤失败都记为trace失败
+	traced := false
+	defer func() {
+		if !traced {
+			metricTraceFailures.inc()
+		}
+	}()
 
-			duration := time.Since(start)
-			if duration > maxDuration {
-				return
-			}
+	start := time.Now()
 
-			defer resp.Body.Close()
-			buf := &bytes.Buffer{}
-			// 创建一个读取操作的超时
-			timeout := time.After(maxDuration)
-			// 使用一个 goroutine 来读取响应体
-			done := make(chan bool)
-			errChan := make(chan error)
-			go func() {
-				_, err := io.Copy(buf, resp.Body)
-				done <- true
-				errChan <- err
-				if err != nil {
-					return
-				}
-			}()
-			// 等待读取操作完成或者超时
-			select {
-			case <-done:
-				// 读取操作完成
-			case <-timeout:
-				// 读取操作超时
-				return
-			}
+	client := http.Client{
+		Transport: newConnTransport(conn),
+		Timeout:   timeout,
+	}
 
-			body := buf
-			err = <-errChan
-			if err != nil {
-				return
-			}
-			if strings.Contains(body.String(), "uag=Mozilla/5.0") {
-				if matches := regexp.MustCompile(`colo=([A-Z]+)[\s\S]*?loc=([A-Z]+)`).FindStringSubmatch(body.String()); len(matches) > 2 {
-					dataCenter := matches[1]
-					locCode := matches[2]
-					loc, ok := locationMap[dataCenter]
-					// 记录通过延迟检查的有效IP
-					atomic.AddInt32(&validCount, 1)
-					if ok {
-						fmt.Printf("发现有效IP %s 端口 %d 位置信息 %s 延迟 %d 毫秒\n", ipAddr, port, loc.City_zh, tcpDuration.Milliseconds())
-						resultChan <- result{ipAddr, port, dataCenter, locCode, loc.Region, loc.City, loc.Region_zh, loc.Country, loc.City_zh, loc.Emoji, fmt.Sprintf("%d ms", tcpDuration.Milliseconds()), tcpDuration}
-					} else {
-						fmt.Printf("发现有效IP %s 端口 %d 位置信息未知 延迟 %d 毫秒\n", ipAddr, port, tcpDuration.Milliseconds())
-						resultChan <- result{ipAddr, port, dataCenter, locCode, "", "", "", "", "", "", fmt.Sprintf("%d ms", tcpDuration.Milliseconds()), tcpDuration}
-					}
-				}
-			}
-		}(ip)
+	var protocol string
+	if portTLS(port) {
+		protocol = "https://"
+	} else {
+		protocol = "http://"
 	}
+	requestURL := protocol + requestURL
 
-	wg.Wait()
-	close(resultChan)
+	req, _ := http.NewRequest("GET", requestURL, nil)
 
-	if len(resultChan) == 0 {
-		// 清除输出内容
-		fmt.Print("\033[2J")
-		fmt.Println("没有发现有效的IP")
-		return
+	// 添加用户代理
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Close = true
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{}, classifyRequestError(err)
 	}
-	var results []speedtestresult
-	if *speedTest > 0 {
-		fmt.Printf("找到符合条件的ip 共%d个\n", atomic.LoadInt32(&validCount))
-		fmt.Printf("开始测速\n")
-		var wg2 sync.WaitGroup
-		wg2.Add(*speedTest)
-		count = 0
-		total := len(resultChan)
-		results = []speedtestresult{}
-		for i := 0; i < *speedTest; i++ {
-			thread <- struct{}{}
-			go func() {
-				defer func() {
-					<-thread
-					wg2.Done()
-				}()
-				for res := range resultChan {
-
-					downloadSpeed := getDownloadSpeed(res.ip, res.port)
+	defer resp.Body.Close()
+
+	duration := time.Since(start)
+	if duration > maxDuration {
+		return result{}, newProbeError(failSlowResponse, fmt.Errorf("%d ms", duration.Milliseconds()))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return result{}, newProbeError(failHTTPStatus, fmt.Errorf("状态码 %d", resp.StatusCode))
+	}
+
+	buf := &bytes.Buffer{}
+	// 创建一个读取操作的超时
+	timeout := time.After(maxDuration)
+	// 使用一个 goroutine 来读取响应体，通道带缓冲以免超时返回后该 goroutine 阻塞泄漏
+	done := make(chan bool, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(buf, resp.Body)
+		done <- true
+		errChan <- err
+	}()
+	// 等待读取操作完成或者超时
+	select {
+	case <-done:
+		// 读取操作完成
+	case <-timeout:
+		// 读取操作超时
+		return result{}, newProbeError(failReadTimeout, nil)
+	}
+
+	body := buf
+	err = <-errChan
+	if err != nil {
+		return result{}, newProbeError(failReadError, err)
+	}
+	if !strings.Contains(body.String(), "uag=Mozilla/5.0") {
+		return result{}, newProbeError(failNoUAG, nil)
+	}
+	matches := regexp.MustCompile(`colo=([A-Z]+)[\s\S]*?loc=([A-Z]+)`).FindStringSubmatch(body.String())
+	if len(matches) <= 2 {
+		return result{}, newProbeError(failNoColo, nil)
+	}
+	traced = true
+	dataCenter := matches[1]
+	locCode := matches[2]
+	loc, ok := locationMap[dataCenter]
+	if ok {
+		fmt.Printf("发现有效IP %s 端口 %d 位置信息 %s 延迟 %d 毫秒\n", ipAddr, port, loc.City_zh, tcpDuration.Milliseconds())
+		return result{ipAddr, port, dataCenter, locCode, loc.Region, loc.City, loc.Region_zh, loc.Country, loc.City_zh, loc.Emoji, fmt.Sprintf("%d ms", tcpDuration.Milliseconds()), tcpDuration, c.source, describeTLS(resp.TLS)}, nil
+	}
+	fmt.Printf("发现有效IP %s 端口 %d 位置信息未知 延迟 %d 毫秒\n", ipAddr, port, tcpDuration.Milliseconds())
+	return result{ipAddr, port, dataCenter, locCode, "", "", "", "", "", "", fmt.Sprintf("%d ms", tcpDuration.Milliseconds()), tcpDuration, c.source, describeTLS(resp.TLS)}, nil
+}
+
+// 对已通过延迟检测的IP进行下载测速并收集结果
+func runSpeedTests(resultChan <-chan result, total int) []speedtestresult {
+	resetFailures()
+	defer closeFailures()
+	results := []speedtestresult{}
+	for res := range speedTestStage(resultChan, total) {
+		results = append(results, res)
+	}
+	return results
+}
+
+// 启动下载测速阶段，输出通道在所有输入测速完成后关闭；total 未知时为0，此时不打印百分比，延迟检测结束后才进入测速阶段
+func speedTestStage(resultChan <-chan result, total int) <-chan speedtestresult {
+	fmt.Printf("开始测速\n")
+	if *subnetLimit > 0 && *speedConns > *subnetLimit {
+		fmt.Printf("-speed-conns 超过 -subnet-limit，每个IP最多使用 %d 个测速连接\n", *subnetLimit)
+	}
+	var count, qualified int32
+	if total > 0 {
+		startProgress("speedtest", total)
+	} else {
+		resultChan = enterSpeedTestStage(resultChan, &count)
+	}
+	// 设置 -target 时按延迟排序测速，达标IP数量足够后停止，正在进行的测速仍会完成
+	var stop chan struct{}
+	if *target > 0 {
+		stop = make(chan struct{})
+		resultChan = orderByLatency(resultChan, stop)
+	}
+	resetDataUsage()
+	// 达标IP数量足够后取消仍在排队等待并发名额的测速
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan speedtestresult, *speedTest)
+	var wg2 sync.WaitGroup
+	wg2.Add(*speedTest)
+	for i := 0; i < *speedTest; i++ {
+		go func() {
+			defer wg2.Done()
+			for res := range resultChan {
+				if budgetExhausted() {
+					// 流量预算用完后剩余的IP不再测速，也不记为失败，只计入进度和跳过数量
+					atomic.AddInt32(&budgetSkipped, 1)
+				} else if tested, err := testSpeeds(ctx, res); errors.Is(err, context.Canceled) {
+					// 已找到足够的达标IP，没有开始测速
+				} else if errors.Is(err, errBudgetExhausted) {
+					// 测速中途预算用完，截断的样本作废，按跳过计数
+					atomic.AddInt32(&budgetSkipped, 1)
+				} else if err != nil {
+					recordFailure(res.ip, res.port, res.source, "speedtest", err)
+				} else {
 					// 速度阈值过滤：只添加满足条件的IP到结果中
-					if downloadSpeed > 0 {
-						results = append(results, speedtestresult{result: res, downloadSpeed: downloadSpeed})
+					out <- tested
+					if stop != nil && atomic.AddInt32(&qualified, 1) == int32(*target) {
+						close(stop)
+						cancel()
 					}
+				}
 
-					count++
-					percentage := float64(count) / float64(total) * 100
+				done := atomic.AddInt32(&count, 1)
+				updateProgress(func(s *scanStatus) {
+					if s.Stage == "speedtest" && int(done) > s.Done {
+						s.Done = int(done)
+					}
+				})
+				if total > 0 {
+					percentage := float64(done) / float64(total) * 100
 					fmt.Printf("已完成: %.2f%%\r", percentage)
-					if count == total {
+					if int(done) == total {
 						fmt.Printf("已完成: %.2f%%\033[0\n", percentage)
 					}
 				}
-			}()
-		}
+			}
+		}()
+	}
+	go func() {
 		wg2.Wait()
-	} else {
-		for res := range resultChan {
-			results = append(results, speedtestresult{result: res})
+		cancel()
+		close(out)
+	}()
+	return out
+}
+
+// 与延迟检测同时进行时测速总数未知: 转发延迟检测的结果，延迟检测结束后切换到测速阶段，
+// 总数为收到的IP数量，已完成数量从 done 中读取
+func enterSpeedTestStage(in <-chan result, done *int32) <-chan result {
+	out := make(chan result)
+	go func() {
+		defer close(out)
+		received := 0
+		for res := range in {
+			received++
+			out <- res
 		}
+		updateProgress(func(s *scanStatus) {
+			s.Stage = "speedtest"
+			s.Total = received
+			s.Done = int(atomic.LoadInt32(done))
+		})
+	}()
+	return out
+}
+
+func sortResults(results []speedtestresult) {
+	switch *sortBy {
+	case "latency":
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].result.tcpDuration < results[j].result.tcpDuration
+		})
+		return
+	case "upload":
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].uploadSpeed > results[j].uploadSpeed
+		})
+		return
+	case "download":
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].downloadSpeed > results[j].downloadSpeed
+		})
+		return
 	}
 
 	if *speedTest > 0 {
@@ -1019,37 +1270,31 @@ func runOriginalMain() {
 			return results[i].result.tcpDuration < results[j].result.tcpDuration
 		})
 	}
+}
 
-	file, err := os.Create(*outFile)
-	if err != nil {
-		fmt.Printf("无法创建文件: %v\n", err)
-		return
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	if *speedTest > 0 {
-		writer.Write([]string{"IP地址", "端口", "TLS", "数据中心", "源IP位置", "地区", "城市", "地区(中文)", "国家", "城市(中文)", "国旗", "网络延迟", "下载速度(MB/s)"})
-	} else {
-		writer.Write([]string{"IP地址", "端口", "TLS", "数据中心", "源IP位置", "地区", "城市", "地区(中文)", "国家", "城市(中文)", "国旗", "网络延迟"})
-	}
-	for _, res := range results {
-		if *speedTest > 0 {
-			speedMBs := res.downloadSpeed / 1024
-			if speedMBs >= 1 {
-				writer.Write([]string{res.result.ip, strconv.Itoa(res.result.port), strconv.FormatBool(*enableTLS), res.result.dataCenter, res.result.locCode, res.result.region, res.result.city, res.result.region_zh, res.result.country, res.result.city_zh, res.result.emoji, res.result.latency, fmt.Sprintf("%.2f", speedMBs)})
-			} else {
-				writer.Write([]string{res.result.ip, strconv.Itoa(res.result.port), strconv.FormatBool(*enableTLS), res.result.dataCenter, res.result.locCode, res.result.region, res.result.city, res.result.region_zh, res.result.country, res.result.city_zh, res.result.emoji, res.result.latency, fmt.Sprintf("%.3f", speedMBs)})
-			}
-		} else {
-			writer.Write([]string{res.result.ip, strconv.Itoa(res.result.port), strconv.FormatBool(*enableTLS), res.result.dataCenter, res.result.locCode, res.result.region, res.result.city, res.result.region_zh, res.result.country, res.result.city_zh, res.result.emoji, res.result.latency})
+// 扫描结束后的收尾工作：写入结果文件、上传、更新DNS并发送通知
+func finishScan(results []speedtestresult, validCount int32, startTime time.Time, streamed bool) error {
+	// 扫描过程中已逐条输出到标准输出的结果不再重复输出，写入文件的结果按排序重写
+	if !streamed || *outFile != "-" {
+		if err := writeResultsCSV(*outFile, results); err != nil {
+			return fmt.Errorf("无法创建文件: %v", err)
 		}
 	}
 
-	writer.Flush()
 	// 清除输出内容
 	fmt.Print("\033[2J")
-	fmt.Printf("有效IP数量: %d | 成功将结果写入文件 %s，耗时 %d秒\n", atomic.LoadInt32(&validCount), *outFile, time.Since(startTime)/time.Second)
+	outName := *outFile
+	if outName == "-" {
+		outName = "标准输出"
+	}
+	fmt.Printf("有效IP数量: %d | 成功将结果写入文件 %s，耗时 %d秒\n", validCount, outName, time.Since(startTime)/time.Second)
+	if err := reportPorts(*outFile, results); err != nil {
+		fmt.Println(err)
+	}
+	if *speedTest > 0 {
+		printDataUsage()
+	}
+	printFailureSummary()
 
 	// 上传结果到API（如果配置了）
 	if *uploadURL != "" {
@@ -1058,17 +1303,156 @@ func runOriginalMain() {
 			fmt.Printf("上传失败: %v\n", err)
 		}
 	}
+
+	// 将前N个IP写入Cloudflare DNS（如果配置了）
+	if *cfName != "" {
+		fmt.Println("正在更新Cloudflare DNS记录...")
+		if err := updateCloudflareDNS(results); err != nil {
+			fmt.Printf("DNS更新失败: %v\n", err)
+		}
+	}
+
+	sendNotifications(buildNotifySummary(results, validCount, startTime))
+	return nil
 }
 
-// 从文件中读取IP地址和端口
-func readIPs(File string) ([]string, error) {
-	file, err := os.Open(File)
+// 将结果写入CSV文件
+func writeResultsCSV(filename string, results []speedtestresult) error {
+	if filename == "-" {
+		return writeResults(resultStdout, results)
+	}
+	file, err := os.Create(filename)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
-	var ips []string
-	scanner := bufio.NewScanner(file)
+
+	return writeResults(file, results)
+}
+
+// 结果输出到标准输出时使用的原始 os.Stdout
+var resultStdout = os.Stdout
+
+// -outfile - 时结果独占标准输出，进度等提示信息改为输出到标准错误
+func redirectProgressOutput() {
+	if *outFile == "-" {
+		os.Stdout = os.Stderr
+	}
+}
+
+// 逐条写入结果CSV，文件在写入第一条结果时才创建，没有结果时不会覆盖已有文件
+type resultWriter struct {
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+	writer   *csv.Writer
+	err      error
+}
+
+func newResultWriter(filename string) *resultWriter {
+	return &resultWriter{filename: filename}
+}
+
+// 写入一条结果并立即刷新，出错后忽略后续写入
+func (rw *resultWriter) write(res speedtestresult) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return
+	}
+	if rw.writer == nil {
+		if rw.filename == "-" {
+			rw.writer = csv.NewWriter(resultStdout)
+		} else {
+			file, err := os.Create(rw.filename)
+			if err != nil {
+				rw.err = err
+				return
+			}
+			rw.file = file
+			rw.writer = csv.NewWriter(file)
+		}
+		rw.writer.Write(csvHeader())
+	}
+	rw.writer.Write(csvRecord(res))
+	rw.writer.Flush()
+	rw.err = rw.writer.Error()
+}
+
+// 关闭文件并返回写入过程中的第一个错误
+func (rw *resultWriter) close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file != nil {
+		if err := rw.file.Close(); err != nil && rw.err == nil {
+			rw.err = err
+		}
+		rw.file = nil
+	}
+	return rw.err
+}
+
+// 以CSV格式写出结果，表头根据是否启用测速决定
+func writeResults(w io.Writer, results []speedtestresult) error {
+	writer := csv.NewWriter(w)
+	writer.Write(csvHeader())
+	for _, res := range results {
+		writer.Write(csvRecord(res))
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// CSV表头
+func csvHeader() []string {
+	header := []string{"IP地址", "端口", "TLS", "数据中心", "源IP位置", "地区", "城市", "地区(中文)", "国家", "城市(中文)", "国旗", "网络延迟"}
+	if *speedTest > 0 {
+		header = append(header, "下载速度(MB/s)", "峰值速度(MB/s)", "中位速度(MB/s)", "速度采样(MB/s)")
+		if *speedConns > 1 {
+			header = append(header, "单连接速度(MB/s)")
+		}
+		if *upTest {
+			header = append(header, "上传速度(MB/s)")
+		}
+	}
+	if anyPortTLS() {
+		header = append(header, "TLS版本", "加密套件", "证书签发者")
+	}
+	header = append(header, "来源")
+	return header
+}
+
+// 单条结果对应的CSV记录
+func csvRecord(res speedtestresult) []string {
+	record := []string{res.result.ip, strconv.Itoa(res.result.port), strconv.FormatBool(portTLS(res.result.port)), res.result.dataCenter, res.result.locCode, res.result.region, res.result.city, res.result.region_zh, res.result.country, res.result.city_zh, res.result.emoji, res.result.latency}
+	if *speedTest > 0 {
+		record = append(record, formatSpeedMBs(res.downloadSpeed), formatSpeedMBs(res.peakSpeed), formatSpeedMBs(res.medianSpeed), formatSamples(res.speedSamples))
+		if *speedConns > 1 {
+			record = append(record, formatSamples(res.connSpeeds))
+		}
+		if *upTest {
+			record = append(record, formatSpeedMBs(res.uploadSpeed))
+		}
+	}
+	if anyPortTLS() {
+		record = append(record, res.result.tls.version, res.result.tls.cipher, res.result.tls.issuer)
+	}
+	record = append(record, res.result.source)
+	return record
+}
+
+// 逐行解析 "IP 端口" 格式的候选列表
+func parseIPs(r io.Reader, source string) ([]candidate, error) {
+	var ips []candidate
+	err := scanIPLines(r, source, func(c candidate) {
+		ips = append(ips, c)
+	})
+	return ips, err
+}
+
+// 逐行读取 "IP 端口" 格式的候选IP，每解析出一个调用一次 fn
+func scanIPLines(r io.Reader, source string, fn func(candidate)) error {
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		parts := strings.Fields(line)
@@ -1085,10 +1469,9 @@ func readIPs(File string) ([]string, error) {
 			continue
 		}
 
-		ip := fmt.Sprintf("%s %d", ipAddr, port)
-		ips = append(ips, ip)
+		fn(candidate{ip: ipAddr, port: port, source: source})
 	}
-	return ips, scanner.Err()
+	return scanner.Err()
 }
 
 // inc函数实现ip地址自增
@@ -1101,72 +1484,6 @@ func inc(ip net.IP) {
 	}
 }
 
-// 测速函数
-func getDownloadSpeed(ip string, port int) float64 {
-	var protocol string
-	if *enableTLS {
-		protocol = "https://"
-	} else {
-		protocol = "http://"
-	}
-	speedTestURL := protocol + *speedTestURL
-	// 创建请求
-	req, _ := http.NewRequest("GET", speedTestURL, nil)
-	req.Header.Set("User-Agent", "Mozilla/5.0")
-
-	// 创建TCP连接
-	dialer := &net.Dialer{
-		Timeout:   timeout,
-		KeepAlive: 0,
-	}
-	conn, err := dialer.Dial("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
-	if err != nil {
-		return 0
-	}
-	defer conn.Close()
-
-	fmt.Printf("正在测试IP %s 端口 %d\n", ip, port)
-	startTime := time.Now()
-	// 创建HTTP客户端
-	client := http.Client{
-		Transport: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return conn, nil
-			},
-		},
-		//设置单个IP测速最长时间为5秒
-		Timeout: 5 * time.Second,
-	}
-	// 发送请求
-	req.Close = true
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("IP %s 端口 %d 测速无效\n", ip, port)
-		return 0
-	}
-	defer resp.Body.Close()
-
-	// 复制响应体到/dev/null，并计算下载速度
-	written, _ := io.Copy(io.Discard, resp.Body)
-	duration := time.Since(startTime)
-	speedKBs := float64(written) / duration.Seconds() / 1024
-	speedMBs := speedKBs / 1024
-
-	// 速度阈值过滤
-	if *speedThreshold > 0 && speedMBs < *speedThreshold {
-		fmt.Printf("IP %s 端口 %d 速度 %.2f MB/s 低于阈值 %.2f MB/s，已过滤\n", ip, port, speedMBs, *speedThreshold)
-		return 0
-	}
-
-	// 输出结果 - 使用MB/s单位显示
-	if speedMBs >= 1 {
-		fmt.Printf("IP %s 端口 %d 下载速度 %.2f MB/s\n", ip, port, speedMBs)
-	} else {
-		fmt.Printf("IP %s 端口 %d 下载速度 %.0f kB/s\n", ip, port, speedKBs)
-	}
-	return speedKBs // 仍返回KB/s保持精度
-}
-
 // 上传结果到API
 func uploadResults(results []speedtestresult, uploadURL, token string) error {
 	if uploadURL == "" {
@@ -1177,9 +1494,7 @@ func uploadResults(results []speedtestresult, uploadURL, token string) error {
 	// 格式化为 IP:端口#城市(中文)国旗
 	var ipList []string
 	for _, res := range results {
-		// 尝试获取城市信息（中文名+国旗），处理编码问题
-		cityInfo := getValidCityInfo(res.result.city_zh, res.result.city, res.result.locCode)
-		ipList = append(ipList, fmt.Sprintf("%s:%d#%s", res.result.ip, res.result.port, cityInfo))
+		ipList = append(ipList, formatUploadLine(res))
 	}
 
 	if len(ipList) == 0 {
@@ -1187,37 +1502,24 @@ func uploadResults(results []speedtestresult, uploadURL, token string) error {
 		return nil
 	}
 
-	// 构建上传文本 - 每行一个IP
-	uploadText := strings.Join(ipList, "\n")
-
-	// 创建HTTP请求
-	req, err := http.NewRequest("POST", uploadURL, strings.NewReader(uploadText))
-	if err != nil {
-		return fmt.Errorf("创建请求失败: %v", err)
-	}
-
-	// 设置请求头 - 使用纯文本格式
-	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
-	}
-	req.Header.Set("User-Agent", "IPTest-Tool/1.0")
-
-	// 发送请求
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("上传失败: %v", err)
+	// 分批上传，失败的批次会保存到待重传目录
+	if err := sendUpload(ipList, uploadURL, token); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	fmt.Printf("成功上传 %d 个IP到API (格式: IP:端口#城市(中文))\n", len(ipList))
+	return nil
+}
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		fmt.Printf("成功上传 %d 个IP到API (格式: IP:端口#城市(中文))\n", len(ipList))
-		return nil
-	} else {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("上传失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+// 格式化为 IP:端口#城市(中文)
+func formatUploadLine(res speedtestresult) string {
+	// 尝试获取城市信息（中文名+国旗），处理编码问题
+	// 没有城市名时按数据中心的机场代码(如SIN)查找城市，数据中心未知时才使用源IP位置
+	code := res.result.dataCenter
+	if code == "" {
+		code = res.result.locCode
 	}
+	cityInfo := getValidCityInfo(res.result.city_zh, res.result.city, code)
+	return net.JoinHostPort(res.result.ip, strconv.Itoa(res.result.port)) + "#" + cityInfo
 }
 
 // 从文件上传IP列表
@@ -1251,7 +1553,7 @@ func uploadIPListFromFile(filename, uploadURL, token string) error {
 			if city == "" {
 				city = "Unknown"
 			}
-			ipList = append(ipList, fmt.Sprintf("%s:%d#%s", ip, port, city))
+			ipList = append(ipList, net.JoinHostPort(ip, strconv.Itoa(port))+"#"+city)
 			lineCount++
 		}
 	}
@@ -1267,116 +1569,47 @@ func uploadIPListFromFile(filename, uploadURL, token string) error {
 
 	fmt.Printf("从文件中解析出 %d 个有效IP (总行数: %d)\n", len(ipList), lineCount)
 
-	// 构建上传文本 - 每行一个IP
-	uploadText := strings.Join(ipList, "\n")
-
-	// 创建HTTP请求
-	req, err := http.NewRequest("POST", uploadURL, strings.NewReader(uploadText))
-	if err != nil {
-		return fmt.Errorf("创建请求失败: %v", err)
-	}
-
-	// 设置请求头 - 使用纯文本格式
-	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
-	if token != "" {
-		req.Header.Set("Authorization", "Bearer "+token)
-	}
-	req.Header.Set("User-Agent", "IPTest-Tool/1.0")
-
-	// 发送请求
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("上传失败: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		fmt.Printf("成功上传 %d 个IP到API (格式: IP:端口#城市(中文))\n", len(ipList))
-		return nil
-	} else {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("上传失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	// 分批上传，失败的批次会保存到待重传目录
+	if err := sendUpload(ipList, uploadURL, token); err != nil {
+		return err
 	}
+	fmt.Printf("成功上传 %d 个IP到API (格式: IP:端口#城市(中文))\n", len(ipList))
+	return nil
 }
 
-// 解析IP行用于上传 - 支持多种格式
+// 解析IP行用于上传 - 支持 "IP 端口 [城市]"、"IP:端口"、"[IPv6]:端口"，均可带 #城市
 func parseIPLineForUpload(line string) (ip string, port int, city string) {
 	line = strings.TrimSpace(line)
+	if i := strings.Index(line, "#"); i >= 0 {
+		line, city = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	}
 	if line == "" {
 		return "", 0, ""
 	}
 
-	// 格式1: IP 端口 (标准格式)
-	if strings.Contains(line, " ") && !strings.Contains(line, ":") {
-		parts := strings.Fields(line)
-		if len(parts) >= 2 {
-			ip = parts[0]
-			if p, err := strconv.Atoi(parts[1]); err == nil {
-				port = p
-				// 如果有更多部分，作为城市名
-				if len(parts) >= 3 {
-					city = strings.Join(parts[2:], " ")
-				}
-			}
-		}
-	} else if strings.Contains(line, ":") && !strings.Contains(line, "#") {
-		// 格式2: IP:端口
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 {
-			ip = parts[0]
-			if p, err := strconv.Atoi(parts[1]); err == nil {
-				port = p
-			}
+	var host, portStr string
+	if parts := strings.Fields(line); len(parts) >= 2 {
+		// 格式1: IP 端口 (标准格式)，其余部分作为城市名
+		host, portStr = parts[0], parts[1]
+		if len(parts) >= 3 && city == "" {
+			city = strings.Join(parts[2:], " ")
 		}
-	} else if strings.Contains(line, ":") && strings.Contains(line, "#") {
-		// 格式3: IP:端口#国家描述
-		beforeHash := strings.Split(line, "#")[0]
-		parts := strings.SplitN(beforeHash, ":", 2)
-		if len(parts) == 2 {
-			ip = parts[0]
-			if p, err := strconv.Atoi(parts[1]); err == nil {
-				port = p
-			}
-		}
-		// 提取国家描述作为城市
-		if hashParts := strings.SplitN(line, "#", 2); len(hashParts) == 2 {
-			city = hashParts[1]
+	} else {
+		// 格式2: IP:端口 或 [IPv6]:端口
+		h, p, err := net.SplitHostPort(line)
+		if err != nil {
+			return "", 0, ""
 		}
+		host, portStr = h, p
 	}
 
-	// 验证IP地址格式
-	if !isValidIPForUpload(ip) {
-		return "", 0, ""
-	}
-
-	// 验证端口范围
-	if port < 1 || port > 65535 {
+	// 验证IP地址格式和端口范围
+	parsed := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if parsed == nil || err != nil || port < 1 || port > 65535 {
 		return "", 0, ""
 	}
-
-	return ip, port, city
-}
-
-// 验证IP地址格式
-func isValidIPForUpload(ip string) bool {
-	if ip == "" {
-		return false
-	}
-
-	parts := strings.Split(ip, ".")
-	if len(parts) != 4 {
-		return false
-	}
-
-	for _, part := range parts {
-		num, err := strconv.Atoi(part)
-		if err != nil || num < 0 || num > 255 {
-			return false
-		}
-	}
-
-	return true
+	return parsed.String(), port, city
 }
 
 // 获取有效的城市信息（中文名+国旗），处理编码问题
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	exhaustedRetries = 10                    // 本地资源不足时单个候选IP的最大重试次数
+	exhaustedBackoff = 50 * time.Millisecond // 首次重试前的等待时间，之后每次翻倍
+	recoverAfter     = 200                   // 连续成功建立多少个连接后放宽一次并发上限
+)
+
+var (
+	connRate    = flag.Int("rate", 0, "全局每秒新建连接数上限(延迟检测和下载测速共用)，0为不限制")
+	subnetLimit = flag.Int("subnet-limit", 0, "同一 /24 网段(IPv6 为 /48)的最大并发连接数，0为不限制")
+)
+
+var (
+	rateMu   sync.Mutex
+	rateNext time.Time // 下一个连接允许发起的时间
+
+	subnets = newSubnetLimiter()
+	conns   = newAdaptiveLimiter()
+)
+
+// 按 -rate 均匀间隔新建连接，不允许突发
+func waitRate() {
+	if *connRate <= 0 {
+		return
+	}
+	interval := time.Second / time.Duration(*connRate)
+
+	rateMu.Lock()
+	now := time.Now()
+	slot := rateNext
+	if slot.Before(now) {
+		slot = now
+	}
+	rateNext = slot.Add(interval)
+	rateMu.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
+
+// 限制同一网段的并发连接数
+type subnetLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active map[string]int
+}
+
+func newSubnetLimiter() *subnetLimiter {
+	l := &subnetLimiter{active: map[string]int{}}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// 一次占用 n 个名额(n 不超过 -subnet-limit)，ctx 结束时放弃等待
+func (l *subnetLimiter) acquire(ctx context.Context, key string, n int) error {
+	defer wakeOnDone(ctx, &l.mu, l.cond)()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active[key]+n > *subnetLimit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.cond.Wait()
+	}
+	l.active[key] += n
+	return nil
+}
+
+func (l *subnetLimiter) release(key string, n int) {
+	l.mu.Lock()
+	// 计数归零后删除，网段数量再多也不会累积
+	if l.active[key] -= n; l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// IP 所在的网段，IPv4 取 /24，IPv6 取 /48，无法解析时原样返回
+func subnetKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// 同时打开的连接数上限，出现本地资源不足时自动收紧，之后逐步放宽
+type adaptiveLimiter struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int // 0 表示尚未触发过资源不足，不限制
+	active    int
+	successes int
+}
+
+func newAdaptiveLimiter() *adaptiveLimiter {
+	l := &adaptiveLimiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// 一次占用最多 n 个名额，上限已收紧到 n 以下时只占用上限个，返回实际占用的数量；ctx 结束时放弃等待
+func (l *adaptiveLimiter) acquire(ctx context.Context, n int) (int, error) {
+	defer wakeOnDone(ctx, &l.mu, l.cond)()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if l.limit > 0 && n > l.limit {
+			n = l.limit
+		}
+		if l.limit == 0 || l.active+n <= l.limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		l.cond.Wait()
+	}
+	l.active += n
+	return n, nil
+}
+
+func (l *adaptiveLimiter) release(n int) {
+	l.mu.Lock()
+	l.active -= n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// ctx 结束时唤醒 cond 上的等待者，让它们检查 ctx 后返回；返回的函数用于停止监听
+// 唤醒时持有锁，避免等待者检查 ctx 之后、进入 Wait 之前错过唤醒
+func wakeOnDone(ctx context.Context, mu *sync.Mutex, cond *sync.Cond) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			cond.Broadcast()
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// 资源不足时把上限降为当前连接数的一半
+func (l *adaptiveLimiter) reduce() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := l.active / 2
+	if limit < 1 {
+		limit = 1
+	}
+	if l.limit == 0 || limit < l.limit {
+		l.limit = limit
+		fmt.Printf("本地资源不足，并发连接数降为 %d\n", limit)
+	}
+	l.successes = 0
+}
+
+// 连接成功建立，累计一定次数后放宽上限
+func (l *adaptiveLimiter) succeed() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return
+	}
+	if l.successes++; l.successes >= recoverAfter {
+		l.successes = 0
+		l.limit += l.limit/10 + 1
+		l.cond.Broadcast()
+	}
+}
+
+// 关闭时归还并发名额的连接
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// 已占用的并发名额(同一网段和全局各一个)，每个连接关闭时归还一个
+type connSlot struct {
+	key string // 网段，未设置 -subnet-limit 时为空
+}
+
+func (s connSlot) release() {
+	conns.release(1)
+	if s.key != "" {
+		subnets.release(s.key, 1)
+	}
+}
+
+// 为同一个IP一次占用 n 个并发名额，返回实际得到的数量(受 -subnet-limit 和自适应上限限制，可能少于 n)
+// 多个测速连接一起占用名额，不会出现各自占着一部分名额互相等待的情况
+func acquireSlots(ctx context.Context, ip string, n int) (connSlot, int, error) {
+	var slot connSlot
+	if *subnetLimit > 0 {
+		slot.key = subnetKey(ip)
+		if n > *subnetLimit {
+			n = *subnetLimit
+		}
+		if err := subnets.acquire(ctx, slot.key, n); err != nil {
+			return slot, 0, err
+		}
+	}
+	granted, err := conns.acquire(ctx, n)
+	if slot.key != "" && granted < n {
+		subnets.release(slot.key, n-granted)
+	}
+	return slot, granted, err
+}
+
+// 受 -rate、-subnet-limit 和自适应并发上限约束的TCP连接，延迟检测和下载测速都通过它建立连接
+// 本地资源不足时收紧并发上限并重试，不会把本机的问题记为目标IP不可用
+// 返回的耗时只包含建立连接本身，不含排队等待的时间
+func dialCandidate(ip string, port int, timeout time.Duration) (net.Conn, time.Duration, error) {
+	return dialLimited("tcp", ip, port, timeout)
+}
+
+// 按同样的限制建立指定类型的连接，h3 模式的UDP探测也占用并发名额
+func dialLimited(network, ip string, port int, timeout time.Duration) (net.Conn, time.Duration, error) {
+	slot, _, err := acquireSlots(context.Background(), ip, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dialSlot(network, ip, port, timeout, slot)
+}
+
+// 使用已占用的名额建立连接，连接关闭或建立失败时归还名额
+func dialSlot(network, ip string, port int, timeout time.Duration, slot connSlot) (net.Conn, time.Duration, error) {
+	backoff := exhaustedBackoff
+	for attempt := 0; ; attempt++ {
+		waitRate()
+
+		dialer := &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 0,
+		}
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		start := time.Now()
+		var conn net.Conn
+		var err error
+		if network == "tcp" && *probeProxy != "" {
+			// 经过代理时耗时包含与代理握手以及代理连接目标的时间
+			conn, err = dialProbeProxy(dialer, addr)
+		} else if err = bindDialer(dialer, network, ip); err == nil {
+			conn, err = dialer.Dial(network, addr)
+		}
+		elapsed := time.Since(start)
+		if err == nil {
+			conns.succeed()
+			return &limitedConn{Conn: conn, release: slot.release}, elapsed, nil
+		}
+
+		if !isResourceExhausted(err) || attempt >= exhaustedRetries {
+			slot.release()
+			return nil, elapsed, err
+		}
+		metricResourceRetries.inc()
+		conns.reduce()
+		time.Sleep(backoff)
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+	}
+}
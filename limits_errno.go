@@ -0,0 +1,21 @@
+//go:build !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// 表示本地资源不足的错误码，Windows 上另外包含 Winsock 的错误码(见 limits_windows.go)
+var exhaustedErrnos = []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS}
+
+// 是否为本地资源不足导致的错误(文件描述符或缓冲区耗尽)，这类失败与目标IP无关
+func isResourceExhausted(err error) bool {
+	for _, errno := range exhaustedErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,6 @@
+package main
+
+// Plan 9 的系统调用错误不是错误码，无法识别资源不足，连接失败按普通失败处理
+func isResourceExhausted(err error) bool {
+	return false
+}
@@ -0,0 +1,35 @@
+//go:build !plan9
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// 模拟拨号返回的错误: *net.OpError 包装 *os.SyscallError 包装错误码
+func dialErrno(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestIsResourceExhausted(t *testing.T) {
+	for _, errno := range exhaustedErrnos {
+		if !isResourceExhausted(dialErrno(errno)) {
+			t.Errorf("错误码 %d (%v) 应视为本地资源不足", uintptr(errno), errno)
+		}
+		if !isResourceExhausted(fmt.Errorf("socks5: %w", dialErrno(errno))) {
+			t.Errorf("包装后的错误码 %d 应视为本地资源不足", uintptr(errno))
+		}
+		if reason := classifyDialError(dialErrno(errno)).reason; reason != failLocalResource {
+			t.Errorf("错误码 %d 分类为 %s，期望 %s", uintptr(errno), reason, failLocalResource)
+		}
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET} {
+		if isResourceExhausted(dialErrno(errno)) {
+			t.Errorf("错误码 %v 不是本地资源不足", errno)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "syscall"
+
+// Winsock 在套接字或缓冲区耗尽时返回 WSAEMFILE 和 WSAENOBUFS，
+// syscall 包在 Windows 上的 EMFILE、ENOBUFS 是 Go 自定义的值，不会与它们匹配
+const (
+	wsaEMFILE  syscall.Errno = 10024
+	wsaENOBUFS syscall.Errno = 10055
+)
+
+func init() {
+	exhaustedErrnos = append(exhaustedErrnos, wsaEMFILE, wsaENOBUFS)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+// Winsock 的错误码与 syscall.EMFILE、syscall.ENOBUFS 不同，需要单独识别
+func TestWinsockResourceErrors(t *testing.T) {
+	for _, errno := range []syscall.Errno{10024, 10055} {
+		if !isResourceExhausted(dialErrno(errno)) {
+			t.Errorf("Winsock 错误码 %d 应视为本地资源不足", uintptr(errno))
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 单调递增计数器
+type counter struct {
+	name, help string
+	value      uint64
+}
+
+func (c *counter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// 累积直方图，桶为各区间上界
+type histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+var (
+	metricProbed          = &counter{name: "iptest_candidates_probed_total", help: "已探测的候选IP数量"}
+	metricDialFailures    = &counter{name: "iptest_dial_failures_total", help: "TCP连接失败次数"}
+	metricLatencyFiltered = &counter{name: "iptest_latency_filtered_total", help: "超过延迟阈值被过滤的IP数量"}
+	metricTraceFailures   = &counter{name: "iptest_trace_failures_total", help: "trace请求失败次数"}
+	metricSpeedFailures   = &counter{name: "iptest_speedtest_failures_total", help: "下载测速失败次数"}
+	metricUploadFailures  = &counter{name: "iptest_uptest_failures_total", help: "上传测速失败次数"}
+	metricResourceRetries = &counter{name: "iptest_resource_retries_total", help: "本地资源不足(EMFILE/ENOBUFS)导致的连接重试次数"}
+	metricSpeedBytes      = &counter{name: "iptest_speedtest_bytes_total", help: "测速传输的字节数(下载和上传合计)"}
+
+	metricTCPLatency = newHistogram("iptest_tcp_latency_seconds", "TCP连接延迟",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.3, 0.5, 1})
+	metricDownloadSpeed = newHistogram("iptest_download_speed_mbytes_per_second", "下载速度(MB/s)",
+		[]float64{0.5, 1, 2, 3, 5, 10, 20, 50, 100})
+	metricUploadSpeed = newHistogram("iptest_upload_speed_mbytes_per_second", "上传速度(MB/s)",
+		[]float64{0.5, 1, 2, 3, 5, 10, 20, 50, 100})
+
+	runMetricsMu    sync.Mutex
+	bestSpeedByColo = map[bestSpeedKey]float64{}
+	lastRunDuration time.Duration
+	lastRunTime     time.Time
+)
+
+// 最佳速度指标的标签，iface 只在多网卡模式下设置
+type bestSpeedKey struct {
+	iface, colo string
+}
+
+// 清除最佳速度指标，多网卡模式开始新一次运行时调用
+func resetRunMetrics() {
+	runMetricsMu.Lock()
+	defer runMetricsMu.Unlock()
+	bestSpeedByColo = map[bestSpeedKey]float64{}
+}
+
+// 记录一次扫描的整体指标，每个数据中心只保留本次运行的最佳速度
+// 多网卡模式下每个网卡的扫描各自记录，按网卡区分，不会互相覆盖
+func recordRunMetrics(results []speedtestresult, duration time.Duration) {
+	iface := bindOverrideName()
+
+	runMetricsMu.Lock()
+	defer runMetricsMu.Unlock()
+
+	if iface == "" {
+		bestSpeedByColo = map[bestSpeedKey]float64{}
+	}
+	for _, res := range results {
+		key := bestSpeedKey{iface, res.result.dataCenter}
+		speedMBs := res.downloadSpeed / 1024
+		if speedMBs > bestSpeedByColo[key] {
+			bestSpeedByColo[key] = speedMBs
+		}
+	}
+	lastRunDuration = duration
+	lastRunTime = time.Now()
+}
+
+// GET /metrics —— Prometheus 文本格式
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+func writeMetrics(w io.Writer) {
+	for _, c := range []*counter{metricProbed, metricDialFailures, metricLatencyFiltered, metricTraceFailures, metricSpeedFailures, metricUploadFailures, metricResourceRetries, metricSpeedBytes} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(&c.value))
+	}
+
+	for _, h := range []*histogram{metricTCPLatency, metricDownloadSpeed, metricUploadSpeed} {
+		h.mu.Lock()
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, upper, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+		fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+		fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+		h.mu.Unlock()
+	}
+
+	writeFailureMetrics(w)
+
+	runMetricsMu.Lock()
+	defer runMetricsMu.Unlock()
+
+	fmt.Fprintf(w, "# HELP iptest_best_speed_mbytes_per_second 最近一次运行中各数据中心的最佳下载速度(MB/s)，多网卡模式下按网卡区分\n# TYPE iptest_best_speed_mbytes_per_second gauge\n")
+	keys := make([]bestSpeedKey, 0, len(bestSpeedByColo))
+	for key := range bestSpeedByColo {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].iface != keys[j].iface {
+			return keys[i].iface < keys[j].iface
+		}
+		return keys[i].colo < keys[j].colo
+	})
+	for _, key := range keys {
+		if key.iface == "" {
+			fmt.Fprintf(w, "iptest_best_speed_mbytes_per_second{colo=%q} %g\n", key.colo, bestSpeedByColo[key])
+		} else {
+			fmt.Fprintf(w, "iptest_best_speed_mbytes_per_second{interface=%q,colo=%q} %g\n", key.iface, key.colo, bestSpeedByColo[key])
+		}
+	}
+
+	if !lastRunTime.IsZero() {
+		fmt.Fprintf(w, "# HELP iptest_last_run_duration_seconds 最近一次运行耗时\n# TYPE iptest_last_run_duration_seconds gauge\n")
+		fmt.Fprintf(w, "iptest_last_run_duration_seconds %g\n", lastRunDuration.Seconds())
+		fmt.Fprintf(w, "# HELP iptest_last_run_timestamp_seconds 最近一次运行结束时间\n# TYPE iptest_last_run_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "iptest_last_run_timestamp_seconds %d\n", lastRunTime.Unix())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 每行样本为 名称{标签} 值，标签值为带引号的字符串
+var metricSampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+
+func TestMetricsExposition(t *testing.T) {
+	t.Cleanup(func() {
+		setBindOverride(nil)
+		resetRunMetrics()
+	})
+	speed := func(colo string, mbs float64) speedtestresult {
+		return speedtestresult{result: result{dataCenter: colo}, downloadSpeed: mbs * 1024}
+	}
+
+	// 多网卡模式下各网卡依次记录，同一数据中心的速度不会互相覆盖
+	resetRunMetrics()
+	setBindOverride(&bindTarget{name: "eth0"})
+	recordRunMetrics([]speedtestresult{speed("HKG", 12), speed("HKG", 8), speed("LAX", 3)}, time.Second)
+	setBindOverride(&bindTarget{name: "eth1"})
+	recordRunMetrics([]speedtestresult{speed("HKG", 5)}, time.Second)
+	setBindOverride(nil)
+
+	server := httptest.NewServer(http.HandlerFunc(handleMetrics))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type 为 %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个指标的样本之前有 HELP 和 TYPE，样本名称以声明的指标名开头
+	types := map[string]string{}
+	samples := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				t.Errorf("TYPE 行格式错误: %q", line)
+				continue
+			}
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		m := metricSampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("样本行格式错误: %q", line)
+			continue
+		}
+		name := m[1]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); types[base] == "histogram" {
+				name = base
+			}
+		}
+		if types[name] == "" {
+			t.Errorf("样本 %q 之前没有 TYPE 声明", line)
+		}
+		samples[m[1]+m[2]] = m[3]
+	}
+
+	for sample, want := range map[string]string{
+		`iptest_best_speed_mbytes_per_second{interface="eth0",colo="HKG"}`: "12",
+		`iptest_best_speed_mbytes_per_second{interface="eth0",colo="LAX"}`: "3",
+		`iptest_best_speed_mbytes_per_second{interface="eth1",colo="HKG"}`: "5",
+		`iptest_last_run_duration_seconds`:                                 "1",
+	} {
+		if got := samples[sample]; got != want {
+			t.Errorf("%s 为 %q，期望 %q", sample, got, want)
+		}
+	}
+	if types["iptest_best_speed_mbytes_per_second"] != "gauge" || types["iptest_tcp_latency_seconds"] != "histogram" {
+		t.Errorf("指标类型错误: %v", types)
+	}
+
+	// 单网卡运行替换多网卡的数据，不带网卡标签
+	recordRunMetrics([]speedtestresult{speed("HKG", 7)}, time.Second)
+	var out strings.Builder
+	writeMetrics(&out)
+	if !strings.Contains(out.String(), "iptest_best_speed_mbytes_per_second{colo=\"HKG\"} 7\n") || strings.Contains(out.String(), "interface=") {
+		t.Errorf("单网卡运行后的最佳速度指标:\n%s", out.String())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// 可重复指定的字符串参数
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// 默认通知模板
+const defaultNotifyTemplate = `IP测速完成
+有效IP: {{.ValidCount}} | 结果: {{.ResultCount}} | 耗时: {{.Runtime}}
+{{- if .BestSpeed}}
+最佳速度: {{printf "%.2f" .BestSpeed}} MB/s
+{{- end}}
+{{- range .Top}}
+{{.Line}} {{.LatencyMs}}ms{{if .SpeedMBs}} {{printf "%.2f" .SpeedMBs}}MB/s{{end}}
+{{- end}}
+`
+
+// 通知摘要，也是模板的数据来源
+type notifySummary struct {
+	ValidCount  int           `json:"valid_count"`
+	ResultCount int           `json:"result_count"`
+	BestSpeed   float64       `json:"best_speed_mbs"`
+	Runtime     time.Duration `json:"-"`
+	RuntimeSecs float64       `json:"runtime_seconds"`
+	Top         []notifyEntry `json:"top"`
+	Text        string        `json:"text"`
+}
+
+// 摘要中的单条IP
+type notifyEntry struct {
+	resultJSON
+	Line string `json:"line"` // IP:端口#城市，与上传格式一致
+}
+
+var (
+	notifyTargets stringList
+
+	notifyTop      = flag.Int("notify-top", 5, "通知中包含的前N个IP")
+	notifyTemplate = flag.String("notify-template", "", "通知模板文件(Go text/template)，留空使用内置模板")
+	telegramAPI    = flag.String("telegram-api", "https://api.telegram.org", "Telegram Bot API地址")
+)
+
+func init() {
+	flag.Var(&notifyTargets, "notify", "扫描结束后的通知目标，可重复指定: webhook=URL、telegram=BOT令牌/聊天ID、dingtalk=URL、feishu=URL、wecom=URL、smtp=smtp://用户:密码@主机:端口?from=发件人&to=收件人")
+}
+
+// 生成本次运行的摘要
+func buildNotifySummary(results []speedtestresult, validCount int32, startTime time.Time) notifySummary {
+	summary := notifySummary{
+		ValidCount:  int(validCount),
+		ResultCount: len(results),
+		Runtime:     time.Since(startTime).Round(time.Second),
+	}
+	summary.RuntimeSecs = summary.Runtime.Seconds()
+
+	for i, res := range results {
+		speedMBs := res.downloadSpeed / 1024
+		if speedMBs > summary.BestSpeed {
+			summary.BestSpeed = speedMBs
+		}
+		if i < *notifyTop {
+			summary.Top = append(summary.Top, notifyEntry{resultJSON: toResultJSON(res), Line: formatUploadLine(res)})
+		}
+	}
+	return summary
+}
+
+// 渲染摘要并发送到所有配置的通知目标，单个目标失败不影响其它目标
+func sendNotifications(summary notifySummary) {
+	if len(notifyTargets) == 0 {
+		return
+	}
+
+	text, err := renderNotifyText(summary)
+	if err != nil {
+		fmt.Printf("通知模板渲染失败: %v\n", err)
+		return
+	}
+	summary.Text = text
+
+	for _, target := range notifyTargets {
+		kind, dest, ok := strings.Cut(target, "=")
+		if !ok {
+			fmt.Printf("通知目标格式错误: %s\n", target)
+			continue
+		}
+		if err := sendNotification(kind, dest, summary); err != nil {
+			fmt.Printf("发送 %s 通知失败: %v\n", kind, err)
+		} else {
+			fmt.Printf("已发送 %s 通知\n", kind)
+		}
+	}
+}
+
+func renderNotifyText(summary notifySummary) (string, error) {
+	tmplText := defaultNotifyTemplate
+	if *notifyTemplate != "" {
+		data, err := ioutil.ReadFile(*notifyTemplate)
+		if err != nil {
+			return "", fmt.Errorf("无法读取通知模板: %v", err)
+		}
+		tmplText = string(data)
+	}
+
+	tmpl, err := template.New("notify").Parse(tmplText)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, summary); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func sendNotification(kind, dest string, summary notifySummary) error {
+	switch kind {
+	case "webhook":
+		return postJSON(dest, summary)
+	case "telegram":
+		token, chatID, ok := strings.Cut(dest, "/")
+		if !ok {
+			return fmt.Errorf("格式应为 BOT令牌/聊天ID")
+		}
+		endpoint := strings.TrimSuffix(*telegramAPI, "/") + "/bot" + token + "/sendMessage"
+		return postJSON(endpoint, map[string]string{"chat_id": chatID, "text": summary.Text})
+	case "dingtalk", "wecom":
+		return postJSON(dest, map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": summary.Text},
+		})
+	case "feishu":
+		return postJSON(dest, map[string]interface{}{
+			"msg_type": "text",
+			"content":  map[string]string{"text": summary.Text},
+		})
+	case "smtp":
+		return sendMail(dest, summary.Text)
+	default:
+		return fmt.Errorf("不支持的通知类型: %s", kind)
+	}
+}
+
+// 以JSON格式POST到指定地址
+func postJSON(endpoint string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "IPTest-Tool/1.0")
+
+	client := newManagementClient(10 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// 通过SMTP发送邮件，dest 形如 smtp://用户:密码@主机:端口?from=a@example.com&to=b@example.com,c@example.com
+func sendMail(dest, text string) error {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	from := query.Get("from")
+	to := strings.Split(query.Get("to"), ",")
+	if from == "" || query.Get("to") == "" {
+		return fmt.Errorf("需要指定 from 和 to 参数")
+	}
+
+	var auth smtp.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = smtp.PlainAuth("", u.User.Username(), password, u.Hostname())
+	}
+
+	msg := "From: " + from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", "IP测速结果") + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(text, "\n", "\r\n") + "\r\n"
+	return smtpSend(u, auth, from, to, []byte(msg))
+}
+
+// 与 smtp.SendMail 相同的发信流程，连接经过 -proxy 指定的代理
+func smtpSend(u *url.URL, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := dialManagement(u.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	c, err := smtp.NewClient(conn, u.Hostname())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP服务器不支持认证")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 记录收到的JSON通知
+type notifySink struct {
+	mu       sync.Mutex
+	paths    []string
+	payloads []map[string]interface{}
+}
+
+func startNotifySink(t *testing.T, status int) (*notifySink, string) {
+	t.Helper()
+	sink := &notifySink{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("通知内容不是JSON: %v", err)
+		}
+		sink.mu.Lock()
+		sink.paths = append(sink.paths, r.URL.Path)
+		sink.payloads = append(sink.payloads, payload)
+		sink.mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, "done")
+	}))
+	t.Cleanup(server.Close)
+	return sink, server.URL
+}
+
+func testNotifySummary() notifySummary {
+	return notifySummary{ValidCount: 3, ResultCount: 2, BestSpeed: 12.5, Text: "IP测速完成\n1.1.1.1:443#香港🇭🇰 20ms"}
+}
+
+func TestWebhookNotification(t *testing.T) {
+	sink, url := startNotifySink(t, http.StatusOK)
+	if err := sendNotification("webhook", url+"/hook", testNotifySummary()); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.payloads) != 1 || sink.paths[0] != "/hook" {
+		t.Fatalf("收到 %d 个通知，路径 %v", len(sink.payloads), sink.paths)
+	}
+	payload := sink.payloads[0]
+	if payload["valid_count"] != 3.0 || payload["result_count"] != 2.0 || payload["best_speed_mbs"] != 12.5 {
+		t.Errorf("webhook 摘要字段错误: %v", payload)
+	}
+	if payload["text"] != testNotifySummary().Text {
+		t.Errorf("webhook 文本 %q", payload["text"])
+	}
+}
+
+func TestWebhookNotificationError(t *testing.T) {
+	_, url := startNotifySink(t, http.StatusInternalServerError)
+	err := sendNotification("webhook", url, testNotifySummary())
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("服务端返回500时应该报错，得到 %v", err)
+	}
+}
+
+func TestTelegramNotification(t *testing.T) {
+	sink, url := startNotifySink(t, http.StatusOK)
+	setFlags(t, map[string]string{"telegram-api": url + "/"})
+	if err := sendNotification("telegram", "123:ABC/-10042", testNotifySummary()); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.payloads) != 1 {
+		t.Fatalf("收到 %d 个通知", len(sink.payloads))
+	}
+	if sink.paths[0] != "/bot123:ABC/sendMessage" {
+		t.Errorf("Telegram 请求路径 %s", sink.paths[0])
+	}
+	if sink.payloads[0]["chat_id"] != "-10042" || sink.payloads[0]["text"] != testNotifySummary().Text {
+		t.Errorf("Telegram 请求内容 %v", sink.payloads[0])
+	}
+
+	if err := sendNotification("telegram", "123:ABC", testNotifySummary()); err == nil {
+		t.Error("缺少聊天ID时应该报错")
+	}
+}
+
+// 只实现发信所需命令的假SMTP服务器
+type fakeSMTP struct {
+	mu   sync.Mutex
+	from string
+	to   []string
+	data string
+}
+
+func startFakeSMTP(t *testing.T) (*fakeSMTP, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	server := &fakeSMTP{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, ln.Addr().String()
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250-fake")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(cmd, "AUTH"):
+			reply("235 ok")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.mu.Lock()
+			s.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			s.mu.Unlock()
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.mu.Lock()
+			s.to = append(s.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			s.mu.Unlock()
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPNotification(t *testing.T) {
+	server, addr := startFakeSMTP(t)
+	dest := "smtp://user:secret@" + addr + "?from=iptest@example.com&to=a@example.com,b@example.com"
+	if err := sendNotification("smtp", dest, testNotifySummary()); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.from != "iptest@example.com" {
+		t.Errorf("发件人 %q", server.from)
+	}
+	if strings.Join(server.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("收件人 %q", server.to)
+	}
+	if !strings.Contains(server.data, "1.1.1.1:443#香港🇭🇰 20ms\r\n") || !strings.Contains(server.data, "Content-Type: text/plain; charset=utf-8") {
+		t.Errorf("邮件内容 %q", server.data)
+	}
+
+	if err := sendNotification("smtp", "smtp://"+addr+"?from=iptest@example.com", testNotifySummary()); err == nil {
+		t.Error("缺少收件人时应该报错")
+	}
+}
+
+func TestSMTPNotificationThroughProxy(t *testing.T) {
+	for _, scheme := range []string{"socks5", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			server, addr := startFakeSMTP(t)
+			proxy, proxyURL := startFakeProxy(t, scheme)
+			setFlags(t, map[string]string{"proxy": proxyURL})
+
+			dest := "smtp://" + addr + "?from=iptest@example.com&to=a@example.com"
+			if err := sendNotification("smtp", dest, testNotifySummary()); err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadInt32(&proxy.tunnels); n != 1 {
+				t.Errorf("代理转发了 %d 个连接，期望 1 个", n)
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if !strings.Contains(server.data, "1.1.1.1:443#香港🇭🇰 20ms") {
+				t.Errorf("邮件内容 %q", server.data)
+			}
+		})
+	}
+}
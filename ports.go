@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var portSweep = flag.String("ports", "", "端口扫描: 忽略输入中的端口，对每个IP检测一组端口(all、tls、http 或逗号分隔的端口号)，并按端口自动选择是否使用TLS")
+
+// Cloudflare 代理支持的端口
+var (
+	cfTLSPorts   = []int{443, 2053, 2083, 2087, 2096, 8443}
+	cfPlainPorts = []int{80, 8080, 8880, 2052, 2082, 2086, 2095}
+)
+
+// 解析 -ports，未启用端口扫描时返回 nil
+func sweepPorts() ([]int, error) {
+	switch strings.ToLower(strings.TrimSpace(*portSweep)) {
+	case "":
+		return nil, nil
+	case "all":
+		return append(append([]int{}, cfTLSPorts...), cfPlainPorts...), nil
+	case "tls":
+		return cfTLSPorts, nil
+	case "http":
+		return cfPlainPorts, nil
+	}
+	var ports []int
+	seen := map[int]bool{}
+	for _, s := range splitList([]string{*portSweep}) {
+		port, err := strconv.Atoi(s)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("-ports 端口无效: %s", s)
+		}
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("-ports 没有指定端口")
+	}
+	return ports, nil
+}
+
+// 检查 -ports 参数，明文端口不能使用需要TLS的协议
+func checkPorts() error {
+	ports, err := sweepPorts()
+	if err != nil || *probeProto == "h1" {
+		return err
+	}
+	for _, port := range ports {
+		if !portTLS(port) {
+			return fmt.Errorf("-proto=%s 需要TLS，-ports 中的端口 %d 不使用TLS", *probeProto, port)
+		}
+	}
+	return nil
+}
+
+// 连接该端口时是否使用TLS: 端口扫描时 Cloudflare 的端口按端口决定，其它端口沿用 -tls
+func portTLS(port int) bool {
+	if *portSweep != "" {
+		for _, p := range cfTLSPorts {
+			if p == port {
+				return true
+			}
+		}
+		for _, p := range cfPlainPorts {
+			if p == port {
+				return false
+			}
+		}
+	}
+	return *enableTLS
+}
+
+// 结果中是否有使用TLS的端口，决定是否输出TLS相关的列
+func anyPortTLS() bool {
+	ports, err := sweepPorts()
+	if err != nil || len(ports) == 0 {
+		return *enableTLS
+	}
+	for _, port := range ports {
+		if portTLS(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// 端口扫描: 按IP去重后为每个IP生成 -ports 中的每个端口，total 相应放大
+// 去重表中每个不重复的IP占用一项，内存随不重复的IP数增长
+func expandPorts(in <-chan candidate, total int, ports []int) (<-chan candidate, int) {
+	out := make(chan candidate, candidateBuffer)
+	go func() {
+		defer close(out)
+		seen := map[[16]byte]bool{}
+		for c := range in {
+			if ip := net.ParseIP(c.ip); ip != nil {
+				var key [16]byte
+				copy(key[:], ip.To16())
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			for _, port := range ports {
+				c.port = port
+				out <- c
+			}
+		}
+	}()
+	return out, total * len(ports)
+}
+
+// 输出各端口的汇总，并把每个IP各端口的结果并列写入 name 加 -ports 后缀的文件
+func reportPorts(name string, results []speedtestresult) error {
+	ports, err := sweepPorts()
+	if err != nil || len(ports) == 0 {
+		return err
+	}
+	printPortSummary(ports, results)
+	if name == "-" {
+		return nil
+	}
+	matrix := bindOutFile(name, "ports")
+	if err := writePortMatrixCSV(matrix, ports, results); err != nil {
+		return fmt.Errorf("无法创建文件: %v", err)
+	}
+	fmt.Printf("各端口结果对比已写入 %s\n", matrix)
+	return nil
+}
+
+func printPortSummary(ports []int, results []speedtestresult) {
+	type portStats struct {
+		count   int
+		latency time.Duration
+		speed   float64
+	}
+	stats := map[int]*portStats{}
+	for _, port := range ports {
+		stats[port] = &portStats{}
+	}
+	for _, res := range results {
+		if s, ok := stats[res.result.port]; ok {
+			s.count++
+			s.latency += res.result.tcpDuration
+			s.speed += res.downloadSpeed
+		}
+	}
+
+	fmt.Println("各端口结果:")
+	for _, port := range ports {
+		scheme := "HTTP"
+		if portTLS(port) {
+			scheme = "HTTPS"
+		}
+		s := stats[port]
+		if s.count == 0 {
+			fmt.Printf("  %5d %-5s 无有效IP\n", port, scheme)
+			continue
+		}
+		line := fmt.Sprintf("  %5d %-5s 有效 %d 个，平均延迟 %d ms", port, scheme, s.count, (s.latency / time.Duration(s.count)).Milliseconds())
+		if *speedTest > 0 {
+			line += fmt.Sprintf("，平均下载 %s MB/s", formatSpeedMBs(s.speed/float64(s.count)))
+		}
+		fmt.Println(line)
+	}
+}
+
+// 每个IP一行，按可用端口数从多到少排序，不可用的端口对应列为空
+func writePortMatrixCSV(filename string, ports []int, results []speedtestresult) error {
+	type row struct {
+		base   result
+		byPort map[int]*speedtestresult
+		best   float64 // 各端口中最好的下载速度，未测速时为最低延迟的相反数
+	}
+	rows := map[string]*row{}
+	var ips []string
+	for i := range results {
+		res := &results[i]
+		score := resultScore(res)
+		r, ok := rows[res.result.ip]
+		if !ok {
+			r = &row{base: res.result, byPort: map[int]*speedtestresult{}, best: score}
+			rows[res.result.ip] = r
+			ips = append(ips, res.result.ip)
+		}
+		r.byPort[res.result.port] = res
+		if score > r.best {
+			r.best = score
+		}
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		a, b := rows[ips[i]], rows[ips[j]]
+		if len(a.byPort) != len(b.byPort) {
+			return len(a.byPort) > len(b.byPort)
+		}
+		return a.best > b.best
+	})
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+
+	header := []string{"IP地址", "数据中心", "城市(中文)", "可用端口数"}
+	for _, port := range ports {
+		header = append(header, strconv.Itoa(port)+" 网络延迟")
+		if *speedTest > 0 {
+			header = append(header, strconv.Itoa(port)+" 下载速度(MB/s)")
+		}
+	}
+	writer.Write(header)
+	for _, ip := range ips {
+		r := rows[ip]
+		record := []string{ip, r.base.dataCenter, r.base.city_zh, strconv.Itoa(len(r.byPort))}
+		for _, port := range ports {
+			latency, speed := "", ""
+			if res := r.byPort[port]; res != nil {
+				latency, speed = res.result.latency, formatSpeedMBs(res.downloadSpeed)
+			}
+			record = append(record, latency)
+			if *speedTest > 0 {
+				record = append(record, speed)
+			}
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
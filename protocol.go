@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var probeProto = flag.String("proto", "h1", "检测和测速使用的协议: h1、h2 或 h3(只通过UDP/QUIC测量延迟，trace 仍走TCP，需要 -speedtest=0)")
+
+const (
+	quicVersion1      = 0x00000001
+	quicProbeVersion  = 0x1a2a3a4a // RFC 9000 保留的版本号，服务器必须回复版本协商包
+	quicMinPacketSize = 1200       // 客户端首个数据包的最小长度，过短的包服务器会直接丢弃
+)
+
+// 检查 -proto 参数
+func checkProtocol() error {
+	switch *probeProto {
+	case "h1":
+		return nil
+	case "h3":
+		// 标准库没有QUIC传输，测速只能走TCP，测得的速度不能代表QUIC
+		if *speedTest > 0 {
+			return fmt.Errorf("-proto=h3 只测量QUIC延迟，不支持测速，请同时设置 -speedtest=0")
+		}
+		return nil
+	case "h2":
+		// 标准库客户端只支持经过TLS协商的HTTP/2
+		if !*enableTLS && *portSweep == "" {
+			return fmt.Errorf("-proto=h2 需要启用TLS")
+		}
+		return nil
+	}
+	return fmt.Errorf("-proto 只能是 h1、h2 或 h3")
+}
+
+// 基于已建立的连接创建 http.Transport，按 -proto 选择 HTTP/1.1 或 HTTP/2(通过TLS的ALPN协商)
+// h3 模式下trace请求仍走TCP(标准库没有HTTP/3客户端)，使用HTTP/1.1
+func newConnTransport(conn net.Conn) *http.Transport {
+	// 参数错误已在启动时报告，这里出错时使用默认校验
+	tlsConfig, _ := probeTLSConfig()
+	if *probeProto != "h2" {
+		return &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return conn, nil
+			},
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	return &http.Transport{
+		ForceAttemptHTTP2: true,
+		// 明文请求不能走 h2，也不能让 Transport 自行拨号到域名的真实地址而绕过被测IP
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, newProbeError(failProtocol, fmt.Errorf("h2 需要TLS"))
+		},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			config := &tls.Config{}
+			if tlsConfig != nil {
+				config = tlsConfig.Clone()
+			}
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+			config.NextProtos = []string{"h2"}
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return nil, err
+			}
+			if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+				tlsConn.Close()
+				return nil, newProbeError(failProtocol, fmt.Errorf("服务器未协商 h2"))
+			}
+			return tlsConn, nil
+		},
+	}
+}
+
+// 通过UDP向IP发送QUIC探测包，返回收到版本协商包的往返时间
+// 使用保留版本号触发版本协商，不需要完成TLS握手；服务器必须在支持的版本中列出 QUIC v1
+func probeQUIC(ip string, port int) (time.Duration, error) {
+	conn, _, err := dialLimited("udp", ip, port, timeout)
+	if err != nil {
+		return 0, classifyDialError(err)
+	}
+	defer conn.Close()
+
+	dcid := make([]byte, 8)
+	scid := make([]byte, 8)
+	rand.Read(dcid)
+	rand.Read(scid)
+
+	// 长包头: 首字节、版本、目标连接ID、源连接ID，其余用0填充到最小长度
+	packet := make([]byte, quicMinPacketSize)
+	packet[0] = 0xc0
+	binary.BigEndian.PutUint32(packet[1:5], quicProbeVersion)
+	packet[5] = byte(len(dcid))
+	copy(packet[6:], dcid)
+	packet[14] = byte(len(scid))
+	copy(packet[15:], scid)
+
+	deadline := time.Now().Add(maxDuration)
+	conn.SetDeadline(deadline)
+	start := time.Now()
+	if _, err := conn.Write(packet); err != nil {
+		return 0, newProbeError(failQUICError, err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, newProbeError(failQUICTimeout, nil)
+			}
+			return 0, newProbeError(failQUICError, err)
+		}
+		rtt := time.Since(start)
+		versions, ok := parseVersionNegotiation(buf[:n], scid, dcid)
+		if !ok {
+			// 不是对本次探测的回复，继续等待
+			continue
+		}
+		for _, v := range versions {
+			if v == quicVersion1 {
+				return rtt, nil
+			}
+		}
+		return 0, newProbeError(failProtocol, fmt.Errorf("服务器不支持 QUIC v1"))
+	}
+}
+
+// 解析版本协商包，连接ID必须与探测包对应(目标和源互换)
+func parseVersionNegotiation(p, dcid, scid []byte) ([]uint32, bool) {
+	if len(p) < 7 || p[0]&0x80 == 0 || binary.BigEndian.Uint32(p[1:5]) != 0 {
+		return nil, false
+	}
+	p = p[5:]
+	for _, want := range [][]byte{dcid, scid} {
+		if len(p) < 1 || len(p) < 1+int(p[0]) || !bytes.Equal(p[1:1+int(p[0])], want) {
+			return nil, false
+		}
+		p = p[1+int(p[0]):]
+	}
+	var versions []uint32
+	for ; len(p) >= 4; p = p[4:] {
+		versions = append(versions, binary.BigEndian.Uint32(p[:4]))
+	}
+	return versions, len(versions) > 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// 构造版本协商包: 长包头、版本0、目标和源连接ID，然后是支持的版本列表
+func versionNegotiation(dcid, scid []byte, versions ...uint32) []byte {
+	p := []byte{0x80 | 0x2a, 0, 0, 0, 0}
+	p = append(p, byte(len(dcid)))
+	p = append(p, dcid...)
+	p = append(p, byte(len(scid)))
+	p = append(p, scid...)
+	for _, v := range versions {
+		p = binary.BigEndian.AppendUint32(p, v)
+	}
+	return p
+}
+
+func TestParseVersionNegotiation(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	scid := []byte{9, 10, 11, 12, 13, 14, 15, 16}
+	short := versionNegotiation(dcid, scid, quicVersion1)
+	tests := []struct {
+		name     string
+		packet   []byte
+		versions []uint32
+		ok       bool
+	}{
+		{"v1", versionNegotiation(dcid, scid, 0xff00001d, quicVersion1), []uint32{0xff00001d, quicVersion1}, true},
+		{"没有版本", versionNegotiation(dcid, scid), nil, false},
+		{"目标连接ID不符", versionNegotiation(scid, scid, quicVersion1), nil, false},
+		{"源连接ID不符", versionNegotiation(dcid, dcid, quicVersion1), nil, false},
+		{"短包头", append([]byte{0x40}, short[1:]...), nil, false},
+		{"版本不为0", append([]byte{short[0], 0, 0, 0, 1}, short[5:]...), nil, false},
+		{"连接ID被截断", short[:10], nil, false},
+		{"过短", short[:4], nil, false},
+	}
+	for _, tt := range tests {
+		versions, ok := parseVersionNegotiation(tt.packet, dcid, scid)
+		if ok != tt.ok || len(versions) != len(tt.versions) {
+			t.Errorf("%s: 解析结果 %v, %v，期望 %v, %v", tt.name, versions, ok, tt.versions, tt.ok)
+			continue
+		}
+		for i := range versions {
+			if versions[i] != tt.versions[i] {
+				t.Errorf("%s: 第 %d 个版本 %#x，期望 %#x", tt.name, i+1, versions[i], tt.versions[i])
+			}
+		}
+	}
+}
+
+// 假QUIC服务器，按 reply 的返回值回复探测包，返回 nil 时不回复
+func startFakeQUIC(t *testing.T, reply func(dcid, scid []byte) [][]byte) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// 探测包的连接ID长度固定为8，回复中目标和源互换
+			if n < quicMinPacketSize || buf[5] != 8 || buf[14] != 8 {
+				continue
+			}
+			dcid := append([]byte{}, buf[6:14]...)
+			scid := append([]byte{}, buf[15:23]...)
+			for _, packet := range reply(scid, dcid) {
+				conn.WriteTo(packet, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestProbeQUIC(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  func(dcid, scid []byte) [][]byte
+		reason string // 为空时期望成功
+	}{
+		{"支持v1", func(dcid, scid []byte) [][]byte {
+			return [][]byte{versionNegotiation(dcid, scid, 0xff00001d, quicVersion1)}
+		}, ""},
+		{"先收到无关的包", func(dcid, scid []byte) [][]byte {
+			return [][]byte{versionNegotiation(scid, dcid, quicVersion1), {0x40, 1, 2}, versionNegotiation(dcid, scid, quicVersion1)}
+		}, ""},
+		{"不支持v1", func(dcid, scid []byte) [][]byte {
+			return [][]byte{versionNegotiation(dcid, scid, 0xff00001d)}
+		}, failProtocol},
+		// 等待 maxDuration 后超时
+		{"无回复", func(dcid, scid []byte) [][]byte { return nil }, failQUICTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := startFakeQUIC(t, tt.reply)
+			rtt, err := probeQUIC("127.0.0.1", port)
+			if tt.reason == "" {
+				if err != nil || rtt <= 0 {
+					t.Errorf("探测失败: rtt=%v, err=%v", rtt, err)
+				}
+				return
+			}
+			var pe *probeError
+			if !errors.As(err, &pe) || pe.reason != tt.reason {
+				t.Errorf("失败原因 %v，期望 %s", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestH3RequiresSpeedTestDisabled(t *testing.T) {
+	setFlags(t, map[string]string{"proto": "h3", "speedtest": "5"})
+	if err := checkProtocol(); err == nil {
+		t.Error("-proto=h3 启用测速时应该报错")
+	}
+	setFlags(t, map[string]string{"speedtest": "0"})
+	if err := checkProtocol(); err != nil {
+		t.Errorf("-proto=h3 -speedtest=0 应该通过检查: %v", err)
+	}
+}
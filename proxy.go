@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	mgmtProxy  = flag.String("proxy", "", "管理流量(下载IP列表、locations.json、上传、通知、DNS)使用的代理，如 socks5://127.0.0.1:1080 或 http://127.0.0.1:8080；留空时使用环境变量 HTTPS_PROXY/HTTP_PROXY")
+	probeProxy = flag.String("probe-proxy", "", "延迟检测和测速连接使用的代理(socks5:// 或 http://)，留空则直连")
+)
+
+// 检查代理参数
+func checkProxies() error {
+	if *mgmtProxy != "" {
+		u, err := url.Parse(*mgmtProxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("-proxy 格式错误: %s", *mgmtProxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("-proxy 不支持的协议: %s", u.Scheme)
+		}
+	}
+	if *probeProxy != "" {
+		if _, err := parseProbeProxy(); err != nil {
+			return err
+		}
+		if *probeProto == "h3" {
+			return fmt.Errorf("-probe-proxy 只能代理TCP连接，不能与 -proto=h3 同时使用")
+		}
+	}
+	return nil
+}
+
+// 管理流量使用的HTTP客户端，设置了 -proxy 时通过该代理发出请求
+func newManagementClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if *mgmtProxy == "" {
+		return client
+	}
+	proxyURL, err := url.Parse(*mgmtProxy)
+	if err != nil {
+		return client
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client.Transport = transport
+	return client
+}
+
+// 管理流量中的非HTTP连接(如SMTP)，设置了 -proxy 时通过该代理建立隧道，否则直连
+func dialManagement(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if *mgmtProxy == "" {
+		return dialer.Dial("tcp", addr)
+	}
+	proxyURL, err := url.Parse(*mgmtProxy)
+	if err != nil {
+		return nil, fmt.Errorf("-proxy 格式错误: %s", *mgmtProxy)
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		defaultPorts := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), defaultPorts[proxyURL.Scheme])
+	}
+	conn, err := dialer.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("https代理: %v", err)
+		}
+		conn = tlsConn
+	}
+	tunnel, err := proxyTunnel(conn, proxyURL, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// 在已连接到代理的 conn 上建立到 addr 的隧道
+func proxyTunnel(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL.Scheme == "http" || proxyURL.Scheme == "https" {
+		return httpConnect(conn, proxyURL, addr)
+	}
+	return conn, socks5Connect(conn, proxyURL, addr)
+}
+
+func parseProbeProxy() (*url.URL, error) {
+	u, err := url.Parse(*probeProxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("-probe-proxy 格式错误: %s", *probeProxy)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+		return u, nil
+	}
+	return nil, fmt.Errorf("-probe-proxy 不支持的协议: %s", u.Scheme)
+}
+
+// 通过 -probe-proxy 建立到目标地址的TCP连接，dialer 的超时时间同样用于与代理握手
+func dialProbeProxy(dialer *net.Dialer, addr string) (net.Conn, error) {
+	proxyURL, err := parseProbeProxy()
+	if err != nil {
+		return nil, err
+	}
+	if err := bindDialer(dialer, "tcp", proxyURL.Hostname()); err != nil {
+		return nil, err
+	}
+	conn, err := dialer.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	tunnel, err := proxyTunnel(conn, proxyURL, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// SOCKS5 代理返回的错误码对应的本地错误，便于按连接失败原因分类
+var socks5Errors = map[byte]error{
+	0x03: errNetUnreach,
+	0x04: errHostUnreach,
+	0x05: errConnRefused,
+}
+
+// 按 RFC 1928 发送 CONNECT 请求，支持无认证和用户名/密码认证
+func socks5Connect(conn net.Conn, proxyURL *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	methods := []byte{0x00}
+	if proxyURL.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks5: %v", err)
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		user := proxyURL.User.Username()
+		pass, _ := proxyURL.User.Password()
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("socks5: %v", err)
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("socks5: 用户名或密码错误")
+		}
+	default:
+		return fmt.Errorf("socks5: 代理不接受的认证方式")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if v4 := ip.To4(); v4 != nil {
+		req = append(req, 0x01)
+		req = append(req, v4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 应答: VER REP RSV ATYP BND.ADDR BND.PORT
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return fmt.Errorf("socks5: %v", err)
+	}
+	if head[1] != 0x00 {
+		if cause, ok := socks5Errors[head[1]]; ok {
+			return fmt.Errorf("socks5: %w", cause)
+		}
+		return fmt.Errorf("socks5: 代理返回错误码 %d", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return fmt.Errorf("socks5: %v", err)
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("socks5: 无效的地址类型 %d", head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("socks5: %v", err)
+	}
+	return nil
+}
+
+// 通过HTTP代理的 CONNECT 方法建立隧道
+func httpConnect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxyURL.User != nil {
+		pass, _ := proxyURL.User.Password()
+		token := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + token + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	// 请求方法为 CONNECT 时成功的响应没有响应体，不会等待读取到连接关闭
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, fmt.Errorf("http代理: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http代理: CONNECT 返回 %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// 读取时先返回已缓冲数据的连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResultsCSVRoundTrip(t *testing.T) {
+	setFlags(t, map[string]string{
+		"speedtest":   "2",
+		"speed-conns": "2",
+		"uptest":      "true",
+		"tls":         "true",
+		"ports":       "",
+	})
+	want := []speedtestresult{{
+		result: result{
+			ip: "1.1.1.1", port: 443, dataCenter: "HKG", locCode: "SG",
+			region: "Asia Pacific", city: "Hong Kong", region_zh: "亚太", country: "Hong Kong", city_zh: "香港", emoji: "🇭🇰",
+			latency: "12 ms", tcpDuration: 12 * time.Millisecond, source: "ip.txt",
+			tls: tlsDetails{"TLS 1.3", "TLS_AES_128_GCM_SHA256", "Test CA"},
+		},
+		downloadSpeed: 2048,
+		peakSpeed:     3072,
+		medianSpeed:   2048,
+		speedSamples:  []float64{1024, 3072},
+		uploadSpeed:   512,
+		connSpeeds:    []float64{1024, 1024},
+	}, {
+		// 没有位置信息的结果
+		result: result{ip: "2606:4700::1", port: 8443, dataCenter: "LAX", locCode: "US", latency: "150 ms", tcpDuration: 150 * time.Millisecond},
+	}}
+
+	filename := filepath.Join(t.TempDir(), "ip.csv")
+	if err := writeResultsCSV(filename, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readResultsFromCSV(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("读回 %d 条结果，期望 %d 条", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i].result, want[i].result) {
+			t.Errorf("第 %d 条结果读回为 %+v，期望 %+v", i+1, got[i].result, want[i].result)
+		}
+		if got[i].downloadSpeed != want[i].downloadSpeed || got[i].uploadSpeed != want[i].uploadSpeed || len(got[i].connSpeeds) != len(want[i].connSpeeds) {
+			t.Errorf("第 %d 条结果的速度读回为 %+v", i+1, got[i])
+		}
+	}
+
+	// 重写后的文件与原文件相同，源IP位置不会被数据中心覆盖
+	rewritten := filepath.Join(t.TempDir(), "ip.csv")
+	if err := writeResultsCSV(rewritten, got); err != nil {
+		t.Fatal(err)
+	}
+	again, err := readResultsFromCSV(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again[1].result.locCode != "US" {
+		t.Errorf("重写后源IP位置为 %q，期望 US", again[1].result.locCode)
+	}
+
+	// 没有城市名时上传行按数据中心的机场代码取城市
+	if line := formatUploadLine(got[1]); line != "[2606:4700::1]:8443#洛杉矶" {
+		t.Errorf("上传行为 %q", line)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+// 其它平台没有 RLIMIT_NOFILE，连接数受限时依靠自适应并发降速
+func increaseMaxOpenFiles() {}
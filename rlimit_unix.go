@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// 目标文件描述符上限
+const wantOpenFiles = 65535
+
+// 提升本进程的文件描述符上限(RLIMIT_NOFILE)，软上限最多提升到硬上限
+func increaseMaxOpenFiles() {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		fmt.Printf("读取文件描述符上限时出现错误: %v\n", err)
+		return
+	}
+	if limit.Cur >= wantOpenFiles || limit.Cur >= limit.Max {
+		return
+	}
+
+	old := limit.Cur
+	limit.Cur = wantOpenFiles
+	if limit.Cur > limit.Max {
+		limit.Cur = limit.Max
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		fmt.Printf("提升文件描述符上限时出现错误: %v\n", err)
+		return
+	}
+	fmt.Printf("文件描述符上限已从 %d 提升到 %d\n", old, limit.Cur)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 扫描状态，供 GET /status 查询
+type scanStatus struct {
+	Running    bool      `json:"running"`
+	Stage      string    `json:"stage"` // latency: 延迟检测, speedtest: 下载测速
+	Done       int       `json:"done"`
+	Total      int       `json:"total"`
+	Valid      int       `json:"valid"`
+	Results    int       `json:"results"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// 通过 HTTP API 输出的单条结果
+type resultJSON struct {
+	IP         string    `json:"ip"`
+	Port       int       `json:"port"`
+	TLS        bool      `json:"tls"`
+	Colo       string    `json:"colo"`
+	Loc        string    `json:"loc"`
+	Region     string    `json:"region"`
+	City       string    `json:"city"`
+	RegionZh   string    `json:"region_zh"`
+	Country    string    `json:"country"`
+	CityZh     string    `json:"city_zh"`
+	Emoji      string    `json:"emoji"`
+	LatencyMs  int64     `json:"latency_ms"`
+	SpeedMBs   float64   `json:"speed_mbs"`
+	PeakMBs    float64   `json:"speed_peak_mbs"`
+	MedianMBs  float64   `json:"speed_p50_mbs"`
+	UploadMBs  float64   `json:"upload_mbs"`
+	ConnMBs    []float64 `json:"conn_speeds_mbs,omitempty"`
+	TLSVersion string    `json:"tls_version,omitempty"`
+	TLSCipher  string    `json:"tls_cipher,omitempty"`
+	TLSIssuer  string    `json:"tls_issuer,omitempty"`
+	Source     string    `json:"source"`
+}
+
+var (
+	progressMu sync.Mutex
+	progress   scanStatus
+
+	apiMu        sync.Mutex
+	apiLocations map[string]location
+	apiResults   []speedtestresult
+
+	errScanRunning = errors.New("已有扫描任务正在运行")
+)
+
+// 进入新的扫描阶段
+func startProgress(stage string, total int) {
+	updateProgress(func(s *scanStatus) {
+		s.Stage = stage
+		s.Total = total
+		s.Done = 0
+	})
+}
+
+// 在锁保护下修改扫描状态
+func updateProgress(fn func(s *scanStatus)) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	fn(&progress)
+}
+
+// 读取扫描状态快照
+func currentProgress() scanStatus {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	return progress
+}
+
+// 转换为 JSON 输出结构
+func toResultJSON(res speedtestresult) resultJSON {
+	return resultJSON{
+		IP:         res.result.ip,
+		Port:       res.result.port,
+		TLS:        portTLS(res.result.port),
+		Colo:       res.result.dataCenter,
+		Loc:        res.result.locCode,
+		Region:     res.result.region,
+		City:       res.result.city,
+		RegionZh:   res.result.region_zh,
+		Country:    res.result.country,
+		CityZh:     res.result.city_zh,
+		Emoji:      res.result.emoji,
+		LatencyMs:  res.result.tcpDuration.Milliseconds(),
+		SpeedMBs:   res.downloadSpeed / 1024,
+		PeakMBs:    res.peakSpeed / 1024,
+		MedianMBs:  res.medianSpeed / 1024,
+		UploadMBs:  res.uploadSpeed / 1024,
+		ConnMBs:    connSpeedsMBs(res.connSpeeds),
+		TLSVersion: res.result.tls.version,
+		TLSCipher:  res.result.tls.cipher,
+		TLSIssuer:  res.result.tls.issuer,
+		Source:     res.result.source,
+	}
+}
+
+// 启动 HTTP API 服务
+func serveAPI(addr string) error {
+	increaseMaxOpenFiles()
+	locationMap, err := loadLocations()
+	if err != nil {
+		return err
+	}
+	apiLocations = locationMap
+
+	// 载入上一次运行留下的结果文件，便于服务重启后立即提供数据
+	if fileExists(*outFile) {
+		if results, err := readResultsFromCSV(*outFile); err == nil {
+			apiResults = results
+			fmt.Printf("已载入 %s 中的 %d 条历史结果\n", *outFile, len(results))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", handleScan)
+	mux.HandleFunc("/results", handleResults)
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	fmt.Printf("HTTP API 已启动，监听地址: %s\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// 在后台启动一次扫描，open 在确认没有正在运行的扫描后才打开候选IP流，返回候选数量(未知时为0)
+func startAPIScan(open func() (<-chan candidate, int, error)) (int, error) {
+	progressMu.Lock()
+	if progress.Running {
+		progressMu.Unlock()
+		return 0, errScanRunning
+	}
+	progress = scanStatus{Running: true, StartedAt: time.Now()}
+	progressMu.Unlock()
+
+	cands, total, err := open()
+	if err != nil {
+		updateProgress(func(s *scanStatus) {
+			s.Running = false
+			s.FinishedAt = time.Now()
+			s.LastError = err.Error()
+		})
+		return 0, err
+	}
+
+	go func() {
+		startTime := time.Now()
+		resetFailures()
+		defer closeFailures()
+		rw := newResultWriter(*outFile)
+		results, validCount := runScan(cands, total, apiLocations, rw.write)
+		writeErr := rw.close()
+
+		var lastError string
+		if writeErr != nil {
+			lastError = fmt.Sprintf("写入结果失败: %v", writeErr)
+		}
+		if validCount == 0 {
+			lastError = "没有发现有效的IP"
+			printFailureSummary()
+			sendNotifications(buildNotifySummary(nil, 0, startTime))
+		} else {
+			if err := finishScan(results, validCount, startTime, true); err != nil {
+				lastError = err.Error()
+			}
+		}
+		// 没有有效IP时同样替换，/results 不再返回上一次扫描的结果
+		apiMu.Lock()
+		apiResults = results
+		apiMu.Unlock()
+
+		updateProgress(func(s *scanStatus) {
+			s.Running = false
+			s.Results = len(results)
+			s.FinishedAt = time.Now()
+			s.LastError = lastError
+		})
+	}()
+	return total, nil
+}
+
+// POST /scan —— 请求体为可选的候选列表(每行 "IP 端口")，为空时使用 -source/-file 指定的来源
+func handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅支持 POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ips, err := parseIPs(r.Body, "api")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("读取候选列表失败: %v", err), http.StatusBadRequest)
+		return
+	}
+	open := func() (<-chan candidate, int, error) {
+		// 与 -source/-file 相同，设置了 -ports 时为每个IP展开端口
+		ports, err := sweepPorts()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(ports) > 0 {
+			cands, total := expandPorts(candidateChan(ips), len(ips), ports)
+			return cands, total, nil
+		}
+		return candidateChan(ips), len(ips), nil
+	}
+	if len(ips) == 0 {
+		open = streamCandidates
+	}
+
+	total, err := startAPIScan(open)
+	if err == errScanRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("无法从文件中读取 IP: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// 从来源流式读取时候选数量可能未知，此时为0
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"candidates": total})
+}
+
+// GET /results?format=txt|json|csv&top=N&colo=HKG
+func handleResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "仅支持 GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	apiMu.Lock()
+	results := filterResults(apiResults, query.Get("colo"), 0)
+	apiMu.Unlock()
+
+	if topStr := query.Get("top"); topStr != "" {
+		top, err := strconv.Atoi(topStr)
+		if err != nil || top < 0 {
+			http.Error(w, "top 参数必须为非负整数", http.StatusBadRequest)
+			return
+		}
+		results = filterResults(results, "", top)
+	}
+
+	switch query.Get("format") {
+	case "", "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, res := range results {
+			fmt.Fprintln(w, formatUploadLine(res))
+		}
+	case "json":
+		list := make([]resultJSON, 0, len(results))
+		for _, res := range results {
+			list = append(list, toResultJSON(res))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writeResults(w, results)
+	default:
+		http.Error(w, "format 参数仅支持 txt、json、csv", http.StatusBadRequest)
+	}
+}
+
+// GET /status
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentProgress())
+}
+
+// 按数据中心过滤并截取前N条，top为0表示不限制
+func filterResults(results []speedtestresult, colo string, top int) []speedtestresult {
+	var filtered []speedtestresult
+	for _, res := range results {
+		if colo != "" && !strings.EqualFold(res.result.dataCenter, colo) {
+			continue
+		}
+		filtered = append(filtered, res)
+	}
+	if top > 0 && len(filtered) > top {
+		filtered = filtered[:top]
+	}
+	return filtered
+}
+
+// 多连接测速时各连接的速度(MB/s)，单连接时为空
+func connSpeedsMBs(speeds []float64) []float64 {
+	if len(speeds) < 2 {
+		return nil
+	}
+	mbs := make([]float64, len(speeds))
+	for i, speed := range speeds {
+		mbs[i] = speed / 1024
+	}
+	return mbs
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	sourceCache = flag.String("source-cache", "source_cache", "远程来源的缓存目录，留空则不缓存")
+	sources     stringList
+)
+
+func init() {
+	flag.Var(&sources, "source", "候选IP来源，可重复: 本地文件、通配符(如 lists/*.txt)、http(s) URL 或 - (标准输入)；未指定时使用 -file")
+}
+
+// 远程来源缓存的元数据
+type sourceCacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// 候选IP通道的容量，读取速度超过检测速度时读取方阻塞等待
+const candidateBuffer = 1024
+
+// 去重使用的紧凑键，避免为每个候选IP保存字符串
+type candidateKey struct {
+	ip   [16]byte
+	port int
+}
+
+// 打开候选IP流: 后台逐行读取 -source 指定的各来源(未指定时为 -file)，多个来源时按 IP:端口 去重，先出现的来源优先
+// total 为本地文件的行数，包含标准输入或远程来源时为0(未知)
+func streamCandidates() (<-chan candidate, int, error) {
+	var names []string
+	strict := len(sources) == 0 // -file 保持原有的 "IP 端口" 严格格式
+	if strict {
+		names = []string{*File}
+	}
+	for _, src := range sources {
+		expanded, err := expandSource(src)
+		if err != nil {
+			fmt.Printf("来源 %s 无效: %v\n", src, err)
+			continue
+		}
+		names = append(names, expanded...)
+	}
+
+	// 本地文件在开始扫描前检查是否可读
+	var usable []string
+	for _, name := range names {
+		if name != "-" && !isRemoteSource(name) {
+			if _, err := os.Stat(name); err != nil {
+				if strict {
+					return nil, 0, err
+				}
+				fmt.Printf("读取来源 %s 失败: %v\n", name, err)
+				continue
+			}
+		}
+		usable = append(usable, name)
+	}
+	if len(usable) == 0 {
+		return nil, 0, fmt.Errorf("没有可用的来源")
+	}
+
+	ports, err := sweepPorts()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := countSourceLines(usable)
+	out := make(chan candidate, candidateBuffer)
+	go func() {
+		defer close(out)
+		// 多个来源之间去重，每个不重复的 IP:端口 占用一项，内存随不重复的候选数增长
+		var seen map[candidateKey]bool
+		if len(usable) > 1 {
+			seen = map[candidateKey]bool{}
+		}
+		for _, name := range usable {
+			read, added := 0, 0
+			err := readSource(name, strict, func(c candidate) {
+				read++
+				if seen != nil {
+					if ip := net.ParseIP(c.ip); ip != nil {
+						key := candidateKey{port: c.port}
+						copy(key.ip[:], ip.To16())
+						if seen[key] {
+							return
+						}
+						seen[key] = true
+					}
+				}
+				added++
+				out <- c
+			})
+			if err != nil {
+				fmt.Printf("读取来源 %s 失败: %v\n", name, err)
+				continue
+			}
+			if !strict {
+				fmt.Printf("来源 %s: %d 个IP，去重后新增 %d 个\n", name, read, added)
+			}
+		}
+	}()
+	if len(ports) > 0 {
+		sweep, sweepTotal := expandPorts(out, total, ports)
+		return sweep, sweepTotal, nil
+	}
+	return out, total, nil
+}
+
+// 将已读入内存的候选列表转为候选IP流
+func candidateChan(ips []candidate) <-chan candidate {
+	ch := make(chan candidate, len(ips))
+	for _, c := range ips {
+		ch <- c
+	}
+	close(ch)
+	return ch
+}
+
+// 统计本地来源的非空行数，用于显示进度；包含标准输入或远程来源时返回0
+func countSourceLines(names []string) int {
+	total := 0
+	for _, name := range names {
+		if name == "-" || isRemoteSource(name) {
+			return 0
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return 0
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) != "" {
+				total++
+			}
+		}
+		file.Close()
+	}
+	return total
+}
+
+// 展开通配符来源，URL 和标准输入原样返回
+func expandSource(src string) ([]string, error) {
+	if src == "-" || isRemoteSource(src) {
+		return []string{src}, nil
+	}
+	if !strings.ContainsAny(src, "*?[") {
+		return []string{src}, nil
+	}
+	matches, err := filepath.Glob(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("没有匹配的文件")
+	}
+	return matches, nil
+}
+
+func isRemoteSource(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// 逐行读取单个来源，strict 为 true 时只接受 "IP 端口" 格式
+func readSource(name string, strict bool, fn func(candidate)) error {
+	var r io.Reader
+	switch {
+	case name == "-":
+		r = stdinReader
+		name = "stdin"
+	case isRemoteSource(name):
+		body, err := fetchRemoteSource(name)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		r = body
+	default:
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	if strict {
+		return scanIPLines(r, name, fn)
+	}
+	return scanSourceLines(r, name, fn)
+}
+
+// 宽松解析来源内容: 支持 "IP 端口"、"IP:端口"、"[IPv6]:端口"、"IP:端口#备注" 和只有IP(默认443端口)，忽略空行和 # 注释
+func scanSourceLines(r io.Reader, source string, fn func(candidate)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if ip := net.ParseIP(line); ip != nil {
+			fn(candidate{ip: ip.String(), port: 443, source: source})
+			continue
+		}
+		ip, port, _ := parseIPLineForUpload(line)
+		if ip == "" || port <= 0 || port > 65535 {
+			fmt.Printf("行格式错误: %s\n", line)
+			continue
+		}
+		fn(candidate{ip: ip, port: port, source: source})
+	}
+	return scanner.Err()
+}
+
+// 下载远程来源，带条件请求缓存；网络失败时回退到缓存内容
+func fetchRemoteSource(rawURL string) (io.ReadCloser, error) {
+	bodyPath, metaPath := sourceCachePaths(rawURL)
+
+	var meta sourceCacheMeta
+	if metaPath != "" {
+		if data, err := os.ReadFile(metaPath); err == nil {
+			json.Unmarshal(data, &meta)
+		}
+	}
+
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "IPTest-Tool/1.0")
+	if meta.URL == rawURL {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	// http.Client 默认跟随最多10次重定向
+	client := newManagementClient(30 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return openCachedSource(bodyPath, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		resp.Body.Close()
+		if bodyPath != "" {
+			if file, err := os.Open(bodyPath); err == nil {
+				fmt.Printf("来源 %s 未变化，使用缓存\n", rawURL)
+				return file, nil
+			}
+		}
+		return nil, fmt.Errorf("服务器返回304但缓存不存在")
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return openCachedSource(bodyPath, fmt.Errorf("状态码: %d", resp.StatusCode))
+	}
+
+	if bodyPath == "" {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(*sourceCache, 0755); err != nil {
+		return nil, fmt.Errorf("无法创建缓存目录: %v", err)
+	}
+	tmp := bodyPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("无法写入缓存: %v", err)
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return openCachedSource(bodyPath, err)
+	}
+	file.Close()
+	if err := os.Rename(tmp, bodyPath); err != nil {
+		return nil, fmt.Errorf("无法写入缓存: %v", err)
+	}
+
+	meta = sourceCacheMeta{
+		URL:          rawURL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+	if data, err := json.MarshalIndent(meta, "", "  "); err == nil {
+		os.WriteFile(metaPath, data, 0644)
+	}
+	return os.Open(bodyPath)
+}
+
+// 打开缓存内容，缓存不存在时返回原始错误
+func openCachedSource(bodyPath string, cause error) (io.ReadCloser, error) {
+	if bodyPath == "" {
+		return nil, cause
+	}
+	file, err := os.Open(bodyPath)
+	if err != nil {
+		return nil, cause
+	}
+	fmt.Printf("下载失败(%v)，使用缓存: %s\n", cause, bodyPath)
+	return file, nil
+}
+
+// 缓存文件路径，按URL的哈希命名
+func sourceCachePaths(rawURL string) (body, meta string) {
+	if *sourceCache == "" {
+		return "", ""
+	}
+	sum := sha1.Sum([]byte(rawURL))
+	name := hex.EncodeToString(sum[:8])
+	return filepath.Join(*sourceCache, name+".txt"), filepath.Join(*sourceCache, name+".json")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// 记录条件请求头的远程来源，带有匹配的 If-None-Match 时返回304
+type fakeSource struct {
+	mu       sync.Mutex
+	body     string
+	headers  []http.Header
+	notFound bool
+}
+
+func startFakeSource(t *testing.T, body string) (*fakeSource, *httptest.Server) {
+	t.Helper()
+	src := &fakeSource{body: body}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		src.headers = append(src.headers, r.Header.Clone())
+		if src.notFound {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		io.WriteString(w, src.body)
+	}))
+	t.Cleanup(server.Close)
+	return src, server
+}
+
+func readAllSource(t *testing.T, url string) string {
+	t.Helper()
+	body, err := fetchRemoteSource(url)
+	if err != nil {
+		t.Fatalf("下载来源失败: %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFetchRemoteSourceUsesCache(t *testing.T) {
+	setFlags(t, map[string]string{"source-cache": filepath.Join(t.TempDir(), "cache")})
+	src, server := startFakeSource(t, "1.1.1.1 443\n")
+	url := server.URL + "/ips.txt"
+
+	// 首次下载没有条件请求头，内容写入缓存
+	if got := readAllSource(t, url); got != "1.1.1.1 443\n" {
+		t.Fatalf("首次下载内容 %q", got)
+	}
+	// 服务端内容变化但返回304，应使用缓存而不是新内容
+	src.mu.Lock()
+	src.body = "2.2.2.2 443\n"
+	src.mu.Unlock()
+	if got := readAllSource(t, url); got != "1.1.1.1 443\n" {
+		t.Errorf("304 后读到 %q，期望缓存内容", got)
+	}
+
+	src.mu.Lock()
+	headers := src.headers
+	src.mu.Unlock()
+	if len(headers) != 2 {
+		t.Fatalf("服务端收到 %d 个请求，期望 2 个", len(headers))
+	}
+	if h := headers[0]; h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		t.Errorf("首次请求带有条件请求头: %v", h)
+	}
+	if h := headers[1]; h.Get("If-None-Match") != `"v1"` || h.Get("If-Modified-Since") != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("再次请求的条件请求头 If-None-Match=%q If-Modified-Since=%q", h.Get("If-None-Match"), h.Get("If-Modified-Since"))
+	}
+
+	// 服务端出错时回退到缓存
+	src.mu.Lock()
+	src.notFound = true
+	src.mu.Unlock()
+	if got := readAllSource(t, url); got != "1.1.1.1 443\n" {
+		t.Errorf("下载失败后读到 %q，期望缓存内容", got)
+	}
+
+	// 其他URL没有缓存，出错时返回错误
+	if _, err := fetchRemoteSource(server.URL + "/other.txt"); err == nil {
+		t.Error("没有缓存的来源下载失败时应该报错")
+	}
+}
+
+func TestExpandSourceGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.csv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := expandSource(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("通配符展开为 %v，期望 %v", got, want)
+	}
+	if _, err := expandSource(filepath.Join(dir, "*.json")); err == nil {
+		t.Error("没有匹配的文件时应该报错")
+	}
+	// 普通路径、URL 和标准输入原样返回
+	for _, src := range []string{filepath.Join(dir, "missing.txt"), "https://example.com/*.txt", "-"} {
+		if got, err := expandSource(src); err != nil || len(got) != 1 || got[0] != src {
+			t.Errorf("%s 展开为 %v, %v", src, got, err)
+		}
+	}
+}
+
+func TestStreamCandidatesDedupesAcrossSources(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt": "# 注释\n1.1.1.1 443\n1.1.1.2:8443\n",
+		"b.txt": "1.1.1.1:443#重复\n[2606:4700::1]:443\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, server := startFakeSource(t, "1.1.1.2 8443\n2606:4700:0::1\n1.1.1.3\n")
+	url := server.URL + "/ips.txt"
+	setFlags(t, map[string]string{
+		"source":       filepath.Join(dir, "*.txt"),
+		"source-cache": "",
+		"ports":        "",
+	})
+	sources.Set(url)
+
+	cands, total, err := streamCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 {
+		t.Errorf("包含远程来源时总数应为0(未知)，得到 %d", total)
+	}
+	var got []candidate
+	for c := range cands {
+		got = append(got, c)
+	}
+
+	// 先出现的来源优先，IPv6 按地址而不是写法去重
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	want := []candidate{
+		{ip: "1.1.1.1", port: 443, source: a},
+		{ip: "1.1.1.2", port: 8443, source: a},
+		{ip: "2606:4700::1", port: 443, source: b},
+		{ip: "1.1.1.3", port: 443, source: url},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("候选IP为 %+v，期望 %+v", got, want)
+	}
+}
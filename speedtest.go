@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 速度采样间隔
+const sampleInterval = 100 * time.Millisecond
+
+var (
+	upTest          = flag.Bool("uptest", false, "下载测速后再进行上传测速(需要 -speedtest 大于0)")
+	upTestURL       = flag.String("uptest-url", "speed.cloudflare.com/__up", "上传测速地址，通过被测IP以POST方式发送数据")
+	upTestDuration  = flag.Duration("uptest-duration", 5*time.Second, "上传测速时长")
+	upTestThreshold = flag.Float64("uptest-threshold", 0, "上传速度阈值(MB/s)，低于此值的IP将被过滤，0为不过滤")
+	target          = flag.Int("target", 0, "找到多少个达到速度阈值的IP后停止测速，0为全部测速；设置后按延迟从低到高依次测速")
+	sortBy          = flag.String("sort", "", "结果排序依据: download、upload 或 latency，留空时启用测速按下载速度排序，否则按延迟排序")
+
+	speedDuration    = flag.Duration("speed-duration", 5*time.Second, "下载测速的测量时长(不含预热)")
+	speedWarmup      = flag.Duration("speed-warmup", time.Second, "下载测速开始后不计入结果的预热时长")
+	speedConns       = flag.Int("speed-conns", 1, "每个IP同时建立的下载测速连接数，大于1时速度为各连接合计")
+	speedWarmupBytes = flag.Int64("speed-warmup-bytes", 0, "预热阶段至少下载的字节数，0为不限制；与 -speed-warmup 同时满足后才开始测量")
+)
+
+// 下载测速统计，速度单位均为KB/s
+type speedStats struct {
+	avg     float64   // 测量期间的平均速度
+	peak    float64   // 采样中的最高速度
+	median  float64   // 采样的中位数
+	samples []float64 // 测量期间每100毫秒的速度采样
+	perConn []float64 // 各连接在测量期间的平均速度
+}
+
+// 对通过延迟检测的IP依次进行下载测速和(可选的)上传测速
+// ctx 只用于排队等待并发名额，开始测速后不再受它影响
+func testSpeeds(ctx context.Context, res result) (speedtestresult, error) {
+	stats, err := getDownloadSpeed(ctx, res.ip, res.port)
+	if err != nil {
+		return speedtestresult{}, err
+	}
+	if stats.avg <= 0 {
+		return speedtestresult{}, newProbeError(failReadError, fmt.Errorf("没有下载到数据"))
+	}
+	tested := speedtestresult{result: res, downloadSpeed: stats.avg, peakSpeed: stats.peak, medianSpeed: stats.median, speedSamples: stats.samples, connSpeeds: stats.perConn}
+	if *upTest {
+		if tested.uploadSpeed, err = getUploadSpeed(res.ip, res.port); err != nil {
+			return speedtestresult{}, err
+		}
+	}
+	return tested, nil
+}
+
+// 测速函数，按固定时长测量持续下载速度并跳过预热阶段；失败或低于速度阈值时返回分类后的原因
+// -speed-conns 大于1时同时建立多个连接，速度为各连接合计
+func getDownloadSpeed(waitCtx context.Context, ip string, port int) (speedStats, error) {
+	n := *speedConns
+	if n < 1 {
+		n = 1
+	}
+	if *subnetLimit > 0 && n > *subnetLimit {
+		n = *subnetLimit
+	}
+	// 所有测速连接的并发名额一次占用，排队时间不计入测速超时
+	slot, granted, err := acquireSlots(waitCtx, ip, n)
+	if err != nil {
+		return speedStats{}, err
+	}
+	if granted < n {
+		fmt.Printf("IP %s 端口 %d 受自适应并发上限限制，只使用 %d/%d 个测速连接\n", ip, port, granted, n)
+		n = granted
+	}
+
+	// 连接建立、TLS握手和等待响应头最多5秒，之后按预热和测量时长读取响应体
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second+*speedWarmup+*speedDuration)
+	defer cancel()
+
+	fmt.Printf("正在测试IP %s 端口 %d\n", ip, port)
+	bodies := make([]io.ReadCloser, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i], errs[i] = openDownload(ctx, ip, port, slot)
+		}(i)
+	}
+	wg.Wait()
+
+	var readers []io.Reader
+	var firstErr error
+	var ipBytes int64
+	var budgetCut int32
+	for i, body := range bodies {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		defer body.Close()
+		readers = append(readers, &meteredReader{r: body, ipBytes: &ipBytes, cut: &budgetCut})
+	}
+	// 部分连接失败时合计速度不可比，整个样本作废
+	if firstErr != nil {
+		metricSpeedFailures.inc()
+		if len(readers) > 0 {
+			fmt.Printf("IP %s 端口 %d 只建立了 %d/%d 个测速连接，测速无效: %v\n", ip, port, len(readers), n, firstErr)
+		} else {
+			fmt.Printf("IP %s 端口 %d 测速无效: %v\n", ip, port, firstErr)
+		}
+		return speedStats{}, firstErr
+	}
+
+	stats := measureThroughput(readers)
+	// 流量预算在测量中途用完时样本被截断，既不记录速度也不按阈值过滤
+	if atomic.LoadInt32(&budgetCut) != 0 {
+		fmt.Printf("IP %s 端口 %d 测速中途流量预算用完，放弃本次测速\n", ip, port)
+		return speedStats{}, errBudgetExhausted
+	}
+	speedMBs := stats.avg / 1024
+	metricDownloadSpeed.observe(speedMBs)
+
+	// 速度阈值过滤
+	if *speedThreshold > 0 && speedMBs < *speedThreshold {
+		fmt.Printf("IP %s 端口 %d 速度 %.2f MB/s 低于阈值 %.2f MB/s，已过滤\n", ip, port, speedMBs, *speedThreshold)
+		return speedStats{}, newProbeError(failTooSlow, fmt.Errorf("%.2f MB/s", speedMBs))
+	}
+
+	// 输出结果 - 使用MB/s单位显示
+	if speedMBs >= 1 {
+		fmt.Printf("IP %s 端口 %d 下载速度 %.2f MB/s (峰值 %.2f MB/s, 中位数 %.2f MB/s)\n", ip, port, speedMBs, stats.peak/1024, stats.median/1024)
+	} else {
+		fmt.Printf("IP %s 端口 %d 下载速度 %.0f kB/s (峰值 %.0f kB/s, 中位数 %.0f kB/s)\n", ip, port, stats.avg, stats.peak, stats.median)
+	}
+	if len(stats.perConn) > 1 {
+		fmt.Printf("IP %s 端口 %d 各连接速度(MB/s): %s\n", ip, port, formatSamples(stats.perConn))
+	}
+	return stats, nil
+}
+
+// 关闭时同时关闭底层连接的响应体
+type downloadBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *downloadBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// 使用已占用的名额通过被测IP建立一个连接并发出测速请求，返回响应体
+func openDownload(ctx context.Context, ip string, port int, slot connSlot) (io.ReadCloser, error) {
+	var protocol string
+	if portTLS(port) {
+		protocol = "https://"
+	} else {
+		protocol = "http://"
+	}
+	// 创建请求
+	req, _ := http.NewRequestWithContext(ctx, "GET", protocol+*speedTestURL, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+
+	// 创建TCP连接
+	conn, _, err := dialSlot("tcp", ip, port, timeout, slot)
+	if err != nil {
+		return nil, classifyDialError(err)
+	}
+
+	// 创建HTTP客户端
+	transport := newConnTransport(conn)
+	transport.ResponseHeaderTimeout = 5 * time.Second
+	client := http.Client{Transport: transport}
+	// 发送请求
+	req.Close = true
+	resp, err := client.Do(req)
+	if err != nil {
+		conn.Close()
+		return nil, classifyRequestError(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		conn.Close()
+		return nil, newProbeError(failHTTPStatus, fmt.Errorf("状态码 %d", resp.StatusCode))
+	}
+	return &downloadBody{ReadCloser: resp.Body, conn: conn}, nil
+}
+
+// 同时读取各连接的响应体并每100毫秒采样一次合计速度，预热结束后测量 -speed-duration 时长
+// 全部下载在预热结束前就已完成时，退化为按整个下载过程计算
+func measureThroughput(bodies []io.Reader) speedStats {
+	counts := make([]int64, len(bodies))
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		go func(i int, body io.Reader) {
+			defer wg.Done()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := body.Read(buf)
+				atomic.AddInt64(&counts[i], int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(i, body)
+	}
+	readDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(readDone)
+	}()
+
+	snapshot := func() []int64 {
+		bytes := make([]int64, len(counts))
+		for i := range counts {
+			bytes[i] = atomic.LoadInt64(&counts[i])
+		}
+		return bytes
+	}
+
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	var samples []float64
+	measureIdx := -1 // 测量开始时的采样下标，-1 表示仍在预热
+	var measureStart time.Time
+	measureBytes := make([]int64, len(counts))
+	var lastBytes int64
+	lastTick := start
+
+	for {
+		select {
+		case now := <-ticker.C:
+			bytes := snapshot()
+			total := sumBytes(bytes)
+			samples = append(samples, float64(total-lastBytes)/now.Sub(lastTick).Seconds()/1024)
+			lastBytes, lastTick = total, now
+
+			if measureIdx < 0 {
+				// 预热阶段: 时长和字节数都满足后开始测量
+				if now.Sub(start) >= *speedWarmup && total >= *speedWarmupBytes {
+					measureIdx = len(samples)
+					measureStart, measureBytes = now, bytes
+				}
+			} else if now.Sub(measureStart) >= *speedDuration {
+				return newSpeedStats(samples[measureIdx:], subBytes(bytes, measureBytes), now.Sub(measureStart))
+			}
+		case <-readDone:
+			now := time.Now()
+			bytes := snapshot()
+			total := sumBytes(bytes)
+			if now.Sub(lastTick) >= sampleInterval/2 {
+				// 最后不足一个间隔的部分也计入采样
+				samples = append(samples, float64(total-lastBytes)/now.Sub(lastTick).Seconds()/1024)
+			}
+			if measureIdx < 0 {
+				return newSpeedStats(samples, bytes, now.Sub(start))
+			}
+			return newSpeedStats(samples[measureIdx:], subBytes(bytes, measureBytes), now.Sub(measureStart))
+		}
+	}
+}
+
+func sumBytes(bytes []int64) int64 {
+	var total int64
+	for _, b := range bytes {
+		total += b
+	}
+	return total
+}
+
+func subBytes(bytes, base []int64) []int64 {
+	diff := make([]int64, len(bytes))
+	for i := range bytes {
+		diff[i] = bytes[i] - base[i]
+	}
+	return diff
+}
+
+// 根据测量期间各连接下载的字节数计算统计值
+func newSpeedStats(samples []float64, bytes []int64, elapsed time.Duration) speedStats {
+	stats := speedStats{samples: samples}
+	if elapsed > 0 {
+		for _, b := range bytes {
+			stats.perConn = append(stats.perConn, float64(b)/elapsed.Seconds()/1024)
+		}
+		stats.avg = float64(sumBytes(bytes)) / elapsed.Seconds() / 1024
+	}
+	stats.peak, stats.median = peakAndMedian(samples)
+	if len(samples) == 0 {
+		// 下载在一个采样间隔内就已完成
+		stats.peak, stats.median = stats.avg, stats.avg
+	}
+	return stats
+}
+
+// 采样中的最大值和中位数
+func peakAndMedian(samples []float64) (peak, median float64) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	peak = sorted[len(sorted)-1]
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return peak, (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return peak, sorted[mid]
+}
+
+// 以MB/s格式化速度，小于1MB/s时保留三位小数
+func formatSpeedMBs(speedKBs float64) string {
+	speedMBs := speedKBs / 1024
+	if speedMBs >= 1 {
+		return fmt.Sprintf("%.2f", speedMBs)
+	}
+	return fmt.Sprintf("%.3f", speedMBs)
+}
+
+// 速度采样写入CSV时用空格分隔
+func formatSamples(samples []float64) string {
+	parts := make([]string, len(samples))
+	for i, s := range samples {
+		parts[i] = formatSpeedMBs(s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func parseSamples(s string) []float64 {
+	var samples []float64
+	for _, field := range strings.Fields(s) {
+		if v, err := strconv.ParseFloat(field, 64); err == nil {
+			samples = append(samples, v*1024)
+		}
+	}
+	return samples
+}
+
+// 上传测速时生成的请求体，在截止时间后或流量预算用完时结束
+type uploadBody struct {
+	deadline time.Time
+	sent     int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if time.Now().After(b.deadline) || budgetExhausted() {
+		return 0, io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	b.sent += int64(len(p))
+	consumeBandwidth(len(p))
+	return len(p), nil
+}
+
+// 上传测速，通过被测IP向 -uptest-url 持续POST数据，返回KB/s
+// 以收到响应的时间为结束时间，避免把本地发送缓冲区中的数据算作已上传
+func getUploadSpeed(ip string, port int) (float64, error) {
+	var protocol string
+	if portTLS(port) {
+		protocol = "https://"
+	} else {
+		protocol = "http://"
+	}
+
+	conn, _, err := dialCandidate(ip, port, timeout)
+	if err != nil {
+		metricUploadFailures.inc()
+		return 0, classifyDialError(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second+*upTestDuration)
+	defer cancel()
+	body := &uploadBody{deadline: time.Now().Add(*upTestDuration)}
+	req, _ := http.NewRequestWithContext(ctx, "POST", protocol+*upTestURL, body)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Close = true
+
+	client := http.Client{Transport: newConnTransport(conn)}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		metricUploadFailures.inc()
+		fmt.Printf("IP %s 端口 %d 上传测速无效\n", ip, port)
+		return 0, classifyRequestError(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		metricUploadFailures.inc()
+		fmt.Printf("IP %s 端口 %d 上传测速无效，状态码 %d\n", ip, port, resp.StatusCode)
+		return 0, newProbeError(failHTTPStatus, fmt.Errorf("上传状态码 %d", resp.StatusCode))
+	}
+
+	speedKBs := float64(body.sent) / elapsed.Seconds() / 1024
+	speedMBs := speedKBs / 1024
+	metricUploadSpeed.observe(speedMBs)
+	if *upTestThreshold > 0 && speedMBs < *upTestThreshold {
+		fmt.Printf("IP %s 端口 %d 上传速度 %.2f MB/s 低于阈值 %.2f MB/s，已过滤\n", ip, port, speedMBs, *upTestThreshold)
+		return 0, newProbeError(failUploadTooSlow, fmt.Errorf("%.2f MB/s", speedMBs))
+	}
+	fmt.Printf("IP %s 端口 %d 上传速度 %.2f MB/s\n", ip, port, speedMBs)
+	return speedKBs, nil
+}
+
+// -target 模式下先收集全部通过延迟检测的结果，按延迟从低到高送入测速；stop 关闭后丢弃剩余的IP
+func orderByLatency(in <-chan result, stop <-chan struct{}) <-chan result {
+	out := make(chan result)
+	go func() {
+		defer close(out)
+		var pending []result
+		for res := range in {
+			pending = append(pending, res)
+		}
+		sort.Slice(pending, func(i, j int) bool {
+			return pending[i].tcpDuration < pending[j].tcpDuration
+		})
+		fmt.Printf("按延迟从低到高测速 %d 个IP，找到 %d 个达标IP后停止\n", len(pending), *target)
+		for i, res := range pending {
+			select {
+			case out <- res:
+			case <-stop:
+				fmt.Printf("已找到 %d 个达标IP，跳过剩余 %d 个IP\n", *target, len(pending)-i)
+				return
+			}
+		}
+	}()
+	return out
+}
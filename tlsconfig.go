@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	tlsCAFile   = flag.String("ca", "", "额外信任的CA证书文件(PEM)，与系统根证书一起用于校验")
+	tlsPin      = flag.String("pin", "", "证书SHA-256指纹(十六进制，多个用逗号分隔)，设置后只校验指纹，不校验证书链")
+	tlsInsecure = flag.Bool("insecure", false, "跳过TLS证书校验")
+)
+
+var (
+	tlsMu   sync.Mutex
+	tlsKey  string // 生成 tlsBase 时的参数，参数变化后重新生成
+	tlsBase *tls.Config
+	tlsErr  error
+)
+
+// TLS连接的协商结果
+type tlsDetails struct {
+	version string // TLS版本
+	cipher  string // 加密套件
+	issuer  string // 证书签发者
+}
+
+// 按 -ca、-pin 和 -insecure 生成检测和测速共用的TLS配置，参数不变时复用上次的结果
+// 返回的配置不能修改，需要设置 ServerName 等字段时先 Clone
+func probeTLSConfig() (*tls.Config, error) {
+	key := strings.Join([]string{*tlsCAFile, *tlsPin, strconv.FormatBool(*tlsInsecure)}, "\x00")
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	if tlsBase == nil && tlsErr == nil || key != tlsKey {
+		tlsKey = key
+		tlsBase, tlsErr = buildTLSConfig()
+	}
+	return tlsBase, tlsErr
+}
+
+func buildTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if *tlsCAFile != "" {
+		pem, err := os.ReadFile(*tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取CA证书: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA证书文件 %s 中没有有效的证书", *tlsCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if *tlsPin != "" {
+		pinned := map[string]bool{}
+		for _, pin := range strings.Split(*tlsPin, ",") {
+			pin = normalizeFingerprint(pin)
+			if len(pin) != sha256.Size*2 {
+				return nil, fmt.Errorf("证书指纹格式错误: %s", pin)
+			}
+			pinned[pin] = true
+		}
+		// 固定指纹时证书链和域名由指纹代替校验，便于测试自签名证书
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPinnedCert(cs, pinned)
+		}
+	}
+	if *tlsInsecure {
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// 校验服务器证书的SHA-256指纹
+func verifyPinnedCert(cs tls.ConnectionState, pinned map[string]bool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return newProbeError(failTLS, fmt.Errorf("服务器没有提供证书"))
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	if !pinned[fingerprint] {
+		return newProbeError(failTLS, fmt.Errorf("证书指纹不匹配: %s", fingerprint))
+	}
+	return nil
+}
+
+// 指纹统一为小写十六进制，允许 openssl 输出的冒号分隔格式
+func normalizeFingerprint(pin string) string {
+	pin = strings.ToLower(strings.TrimSpace(pin))
+	pin = strings.TrimPrefix(pin, "sha256:")
+	return strings.ReplaceAll(pin, ":", "")
+}
+
+// 提取TLS连接的版本、加密套件和证书签发者，未使用TLS时为空
+func describeTLS(cs *tls.ConnectionState) tlsDetails {
+	if cs == nil {
+		return tlsDetails{}
+	}
+	details := tlsDetails{
+		version: tlsVersionName(cs.Version),
+		cipher:  tls.CipherSuiteName(cs.CipherSuite),
+	}
+	if len(cs.PeerCertificates) > 0 {
+		issuer := cs.PeerCertificates[0].Issuer
+		details.issuer = issuer.CommonName
+		if details.issuer == "" && len(issuer.Organization) > 0 {
+			details.issuer = issuer.Organization[0]
+		}
+	}
+	return details
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
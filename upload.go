@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	uploadHeaders stringList
+
+	uploadRetries = flag.Int("upload-retries", 3, "上传失败后的重试次数(指数退避)")
+	uploadBatch   = flag.Int("upload-batch", 0, "每批上传的行数，0表示不分批")
+	uploadGzip    = flag.Bool("upload-gzip", false, "上传请求体是否使用gzip压缩")
+	uploadTimeout = flag.Duration("upload-timeout", 10*time.Second, "单次上传请求超时时间")
+	uploadSpool   = flag.String("upload-spool", "upload_spool", "上传失败数据的保存目录，下次上传前会先重传")
+
+	uploadMode      = flag.String("upload-mode", "replace", "上传模式: replace(替换服务端列表)、append(追加)、merge(拉取服务端列表合并去重后写回)")
+	uploadMethod    = flag.String("upload-method", "", "上传使用的HTTP方法，留空时 replace/append 使用POST，merge 使用PUT")
+	uploadFormat    = flag.String("upload-format", "text", "上传请求体格式: text(每行一个IP) 或 json")
+	uploadJSONKey   = flag.String("upload-json-key", "ips", "json格式下存放IP列表的字段名，留空则直接发送数组")
+	uploadMergeKeep = flag.Int("upload-merge-keep", 0, "merge模式下合并后最多保留的条数，0表示不限制")
+)
+
+func init() {
+	flag.Var(&uploadHeaders, "upload-header", "上传时附加的请求头，格式为 \"名称: 值\"，可重复指定")
+}
+
+// 保存在待重传目录中的一次失败上传
+type spoolEntry struct {
+	URL     string    `json:"url"`
+	Mode    string    `json:"mode"`
+	Lines   []string  `json:"lines"`
+	Created time.Time `json:"created"`
+}
+
+// 服务端以 4xx 拒绝的上传，原样重传也会被拒绝，不保存到待重传目录
+var errUploadRejected = errors.New("上传被服务端拒绝")
+
+// 上传IP列表：先重传之前失败的数据，再按批次上传本次数据
+func sendUpload(lines []string, uploadURL, token string) error {
+	switch *uploadMode {
+	case "replace", "append", "merge":
+	default:
+		return fmt.Errorf("不支持的上传模式: %s", *uploadMode)
+	}
+
+	resendSpooled(uploadURL, token)
+
+	if *uploadMode == "merge" {
+		existing, err := fetchUploadedList(uploadURL, token)
+		if err != nil {
+			return fmt.Errorf("获取服务端列表失败: %v", err)
+		}
+		merged := mergeUploadLines(lines, existing, *uploadMergeKeep)
+		fmt.Printf("服务端已有 %d 个IP，合并去重后共 %d 个\n", len(existing), len(merged))
+		lines = merged
+	}
+
+	mode := *uploadMode
+	if mode != "append" && *uploadBatch > 0 && len(lines) > *uploadBatch {
+		fmt.Printf("%s 模式每次请求都会替换服务端列表，忽略 -upload-batch，一次上传全部 %d 行\n", mode, len(lines))
+	}
+	batches := splitBatches(lines, uploadBatchSize(mode))
+	for i, batch := range batches {
+		if len(batches) > 1 {
+			fmt.Printf("正在上传第 %d/%d 批 (%d 行)...\n", i+1, len(batches), len(batch))
+		}
+		if err := postUploadWithRetry(batch, mode, uploadURL, token); err != nil {
+			if errors.Is(err, errUploadRejected) {
+				return err
+			}
+			// 当前批次及其后的批次都保存下来，避免数据丢失
+			var remaining []string
+			for _, rest := range batches[i:] {
+				remaining = append(remaining, rest...)
+			}
+			if spoolFile, spoolErr := saveSpool(uploadURL, mode, remaining); spoolErr != nil {
+				fmt.Printf("保存待重传数据失败: %v\n", spoolErr)
+			} else {
+				fmt.Printf("未上传的 %d 行已保存到 %s，下次上传时会自动重传\n", len(remaining), spoolFile)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// 只有 append 模式可以分批: replace 和 merge 的每个请求都是完整列表，分批会让后一批覆盖前一批
+func uploadBatchSize(mode string) int {
+	if mode != "append" {
+		return 0
+	}
+	return *uploadBatch
+}
+
+// 按行数分批，size<=0 时不分批
+func splitBatches(lines []string, size int) [][]string {
+	if size <= 0 || len(lines) <= size {
+		return [][]string{lines}
+	}
+	var batches [][]string
+	for start := 0; start < len(lines); start += size {
+		end := start + size
+		if end > len(lines) {
+			end = len(lines)
+		}
+		batches = append(batches, lines[start:end])
+	}
+	return batches
+}
+
+// 带指数退避重试的单批上传，4xx 错误不重试
+func postUploadWithRetry(lines []string, mode, uploadURL, token string) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt <= *uploadRetries; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("上传失败: %v，%v 后进行第 %d 次重试\n", err, backoff, attempt)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retryable bool
+		retryable, err = postUpload(lines, mode, uploadURL, token)
+		if err == nil || !retryable {
+			return err
+		}
+	}
+	return err
+}
+
+// 发送一次上传请求，返回错误是否值得重试
+func postUpload(lines []string, mode, uploadURL, token string) (bool, error) {
+	body, contentType, err := encodeUploadBody(lines)
+	if err != nil {
+		return false, err
+	}
+	if *uploadGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	// 创建HTTP请求
+	req, err := http.NewRequest(uploadHTTPMethod(mode), uploadURL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("创建请求失败: %v", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if *uploadGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("X-Upload-Mode", mode)
+	if err := setUploadHeaders(req, token); err != nil {
+		return false, err
+	}
+
+	// 发送请求
+	client := newManagementClient(*uploadTimeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("上传失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return true, fmt.Errorf("上传失败，状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+		}
+		return false, fmt.Errorf("%w，状态码: %d, 响应: %s", errUploadRejected, resp.StatusCode, string(respBody))
+	}
+
+	// 部分API在2xx响应中用 success/ok 字段表示失败
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		var status struct {
+			Success *bool `json:"success"`
+			OK      *bool `json:"ok"`
+		}
+		if json.Unmarshal(respBody, &status) == nil {
+			if (status.Success != nil && !*status.Success) || (status.OK != nil && !*status.OK) {
+				return false, fmt.Errorf("上传被服务端拒绝, 响应: %s", string(respBody))
+			}
+		}
+	}
+	return false, nil
+}
+
+// 上传使用的HTTP方法
+func uploadHTTPMethod(mode string) string {
+	if *uploadMethod != "" {
+		return strings.ToUpper(*uploadMethod)
+	}
+	if mode == "merge" {
+		return "PUT"
+	}
+	return "POST"
+}
+
+// 设置认证、User-Agent 和自定义请求头
+func setUploadHeaders(req *http.Request, token string) error {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("User-Agent", "IPTest-Tool/1.0")
+	for _, header := range uploadHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return fmt.Errorf("请求头格式错误: %s", header)
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return nil
+}
+
+// 按 -upload-format 生成请求体
+func encodeUploadBody(lines []string) ([]byte, string, error) {
+	switch *uploadFormat {
+	case "text":
+		// 构建上传文本 - 每行一个IP
+		return []byte(strings.Join(lines, "\n")), "text/plain; charset=utf-8", nil
+	case "json":
+		var payload interface{} = lines
+		if *uploadJSONKey != "" {
+			payload = map[string][]string{*uploadJSONKey: lines}
+		}
+		data, err := json.Marshal(payload)
+		return data, "application/json", err
+	default:
+		return nil, "", fmt.Errorf("不支持的上传格式: %s", *uploadFormat)
+	}
+}
+
+// merge模式下获取服务端当前的列表，支持纯文本和JSON响应
+func fetchUploadedList(uploadURL, token string) ([]string, error) {
+	req, err := http.NewRequest("GET", uploadURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	if err := setUploadHeaders(req, token); err != nil {
+		return nil, err
+	}
+
+	client := newManagementClient(*uploadTimeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// 服务端还没有列表
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		var list []string
+		if trimmed[0] == '{' {
+			// 找不到列表时不能当作空列表，否则合并后写回会删除服务端已有的数据
+			if *uploadJSONKey == "" {
+				return nil, fmt.Errorf("服务端返回JSON对象，需要用 -upload-json-key 指定列表字段")
+			}
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(trimmed, &obj); err != nil {
+				return nil, fmt.Errorf("无法解析JSON响应: %v", err)
+			}
+			raw, ok := obj[*uploadJSONKey]
+			if !ok {
+				return nil, fmt.Errorf("JSON响应中没有字段 %s", *uploadJSONKey)
+			}
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return nil, fmt.Errorf("无法解析JSON响应的 %s 字段: %v", *uploadJSONKey, err)
+			}
+		} else if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, fmt.Errorf("无法解析JSON响应: %v", err)
+		}
+		return list, nil
+	}
+
+	var list []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return list, nil
+}
+
+// 合并本次结果和服务端列表：按 IP:端口 去重(IPv6 地址按规范形式比较)，本次结果优先(已按速度排序)，keep>0 时只保留前keep条
+func mergeUploadLines(lines, existing []string, keep int) []string {
+	seen := map[string]bool{}
+	var merged []string
+	for _, line := range append(append([]string{}, lines...), existing...) {
+		// 无法解析的行(如域名)原样保留，按整行去重
+		key := strings.TrimSpace(line)
+		if ip, port, _ := parseIPLineForUpload(line); ip != "" {
+			key = net.JoinHostPort(ip, strconv.Itoa(port))
+		}
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, line)
+		if keep > 0 && len(merged) >= keep {
+			break
+		}
+	}
+	return merged
+}
+
+// 将失败的上传保存到待重传目录
+func saveSpool(uploadURL, mode string, lines []string) (string, error) {
+	if err := os.MkdirAll(*uploadSpool, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(spoolEntry{URL: uploadURL, Mode: mode, Lines: lines, Created: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(*uploadSpool, fmt.Sprintf("upload_%s.json", time.Now().Format("20060102_150405.000000000")))
+	return filename, ioutil.WriteFile(filename, data, 0600)
+}
+
+// 重传待重传目录中发往同一地址的数据，成功后删除对应文件
+func resendSpooled(uploadURL, token string) {
+	files, err := filepath.Glob(filepath.Join(*uploadSpool, "upload_*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			fmt.Printf("待重传文件 %s 格式错误: %v\n", file, err)
+			continue
+		}
+		if entry.URL != uploadURL {
+			continue
+		}
+
+		fmt.Printf("正在重传 %s 中的 %d 行...\n", file, len(entry.Lines))
+		if entry.Mode == "" {
+			entry.Mode = "replace"
+		}
+		sent := 0
+		for _, batch := range splitBatches(entry.Lines, uploadBatchSize(entry.Mode)) {
+			if err = postUploadWithRetry(batch, entry.Mode, uploadURL, token); err != nil {
+				break
+			}
+			sent += len(batch)
+		}
+		if errors.Is(err, errUploadRejected) {
+			// 再次重传仍会被拒绝，删除待重传文件
+			os.Remove(file)
+			fmt.Printf("重传被服务端拒绝，删除 %s 中未上传的 %d 行: %v\n", file, len(entry.Lines)-sent, err)
+			continue
+		}
+		if err != nil {
+			// 只保留尚未成功上传的部分
+			entry.Lines = entry.Lines[sent:]
+			if data, marshalErr := json.Marshal(entry); marshalErr == nil {
+				ioutil.WriteFile(file, data, 0600)
+			}
+			fmt.Printf("重传失败，保留 %s: %v\n", file, err)
+			continue
+		}
+		os.Remove(file)
+		fmt.Printf("重传成功，已删除 %s\n", file)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 记录收到的上传请求，每个请求的内容为一批
+type uploadSink struct {
+	mu      sync.Mutex
+	methods []string
+	batches [][]string
+}
+
+func startUploadSink(t *testing.T) (*uploadSink, string) {
+	t.Helper()
+	sink := &uploadSink{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var lines []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		sink.mu.Lock()
+		sink.methods = append(sink.methods, r.Method)
+		sink.batches = append(sink.batches, lines)
+		sink.mu.Unlock()
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return sink, server.URL
+}
+
+func TestUploadBatches(t *testing.T) {
+	lines := []string{"1.1.1.1:443#a", "1.1.1.2:443#b", "1.1.1.3:443#c", "1.1.1.4:443#d", "1.1.1.5:443#e"}
+	tests := []struct {
+		mode        string
+		wantBatches []int // 每个请求的行数
+	}{
+		// replace 的每个请求都会替换服务端列表，不能分批
+		{"replace", []int{5}},
+		{"append", []int{2, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			sink, url := startUploadSink(t)
+			setFlags(t, map[string]string{
+				"upload-mode":  tt.mode,
+				"upload-batch": "2",
+				"upload-spool": t.TempDir(),
+			})
+			if err := sendUpload(lines, url, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			if len(sink.batches) != len(tt.wantBatches) {
+				t.Fatalf("发送了 %d 个请求，期望 %d 个", len(sink.batches), len(tt.wantBatches))
+			}
+			var received []string
+			for i, batch := range sink.batches {
+				if len(batch) != tt.wantBatches[i] {
+					t.Errorf("第 %d 个请求有 %d 行，期望 %d 行", i+1, len(batch), tt.wantBatches[i])
+				}
+				if sink.methods[i] != "POST" {
+					t.Errorf("第 %d 个请求方法为 %s", i+1, sink.methods[i])
+				}
+				received = append(received, batch...)
+			}
+			if strings.Join(received, "\n") != strings.Join(lines, "\n") {
+				t.Errorf("服务端收到的内容 %q 与上传的不同", received)
+			}
+		})
+	}
+}
+
+func TestMergeUploadLines(t *testing.T) {
+	lines := []string{"[2606:4700::1]:443#东京🇯🇵", "1.1.1.1:443#香港🇭🇰"}
+	existing := []string{
+		"[2606:4700:0:0::1]:443#旧", // 与本次结果是同一个地址
+		"[2606:4700::2]:2053#洛杉矶",
+		"1.1.1.1:443#旧",
+		"cdn.example.com:443#域名",
+		"cdn.example.com:443#域名",
+	}
+	want := []string{
+		"[2606:4700::1]:443#东京🇯🇵",
+		"1.1.1.1:443#香港🇭🇰",
+		"[2606:4700::2]:2053#洛杉矶",
+		"cdn.example.com:443#域名",
+	}
+	if got := mergeUploadLines(lines, existing, 0); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("合并结果 %q，期望 %q", got, want)
+	}
+	if got := mergeUploadLines(lines, existing, 3); len(got) != 3 {
+		t.Errorf("keep=3 时保留了 %d 行", len(got))
+	}
+}
+
+func TestParseIPLineForUpload(t *testing.T) {
+	tests := []struct {
+		line string
+		ip   string
+		port int
+		city string
+	}{
+		{"1.1.1.1 443", "1.1.1.1", 443, ""},
+		{"1.1.1.1 8443 香港", "1.1.1.1", 8443, "香港"},
+		{"1.1.1.1:2053", "1.1.1.1", 2053, ""},
+		{"1.1.1.1:443#东京🇯🇵", "1.1.1.1", 443, "东京🇯🇵"},
+		{"[2606:4700::1]:443", "2606:4700::1", 443, ""},
+		{"[2606:4700:0:0::1]:443#洛杉矶", "2606:4700::1", 443, "洛杉矶"},
+		{"2606:4700::1 443", "2606:4700::1", 443, ""},
+		{"cdn.example.com:443", "", 0, ""},
+		{"1.1.1.1:0", "", 0, ""},
+		{"1.1.1", "", 0, ""},
+	}
+	for _, tt := range tests {
+		ip, port, city := parseIPLineForUpload(tt.line)
+		if ip != tt.ip || port != tt.port || city != tt.city {
+			t.Errorf("parseIPLineForUpload(%q) = %q, %d, %q，期望 %q, %d, %q", tt.line, ip, port, city, tt.ip, tt.port, tt.city)
+		}
+	}
+}
+
+func TestScanSourceLinesIPv6(t *testing.T) {
+	input := "[2606:4700::1]:443\n2606:4700::2\n1.1.1.1:2053#香港\n"
+	var got []string
+	if err := scanSourceLines(strings.NewReader(input), "test", func(c candidate) {
+		got = append(got, net.JoinHostPort(c.ip, strconv.Itoa(c.port)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"[2606:4700::1]:443", "[2606:4700::2]:443", "1.1.1.1:2053"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("解析结果 %q，期望 %q", got, want)
+	}
+}
+
+func TestMergeRequiresJSONKeyForObjects(t *testing.T) {
+	var mu sync.Mutex
+	var writes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			io.WriteString(w, `{"updated": "2026-10-01", "ips": ["1.1.1.1:443#香港", "[2606:4700::1]:443#东京"]}`)
+			return
+		}
+		mu.Lock()
+		writes++
+		mu.Unlock()
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+
+	for _, key := range []string{"", "list"} {
+		setFlags(t, map[string]string{"upload-mode": "merge", "upload-json-key": key, "upload-spool": t.TempDir()})
+		if _, err := fetchUploadedList(server.URL, ""); err == nil {
+			t.Errorf("-upload-json-key=%q 找不到列表时应该报错", key)
+		}
+		if err := sendUpload([]string{"1.1.1.2:443#新加坡"}, server.URL, ""); err == nil {
+			t.Errorf("-upload-json-key=%q 找不到列表时不应写回", key)
+		}
+	}
+	mu.Lock()
+	if writes != 0 {
+		t.Errorf("服务端列表未能读取时写回了 %d 次", writes)
+	}
+	mu.Unlock()
+
+	setFlags(t, map[string]string{"upload-json-key": "ips"})
+	list, err := fetchUploadedList(server.URL, "")
+	if err != nil || len(list) != 2 || list[1] != "[2606:4700::1]:443#东京" {
+		t.Errorf("读取服务端列表 %q, %v", list, err)
+	}
+}
+
+func TestRejectedUploadsAreNotSpooled(t *testing.T) {
+	var status int32 = http.StatusUnauthorized
+	var mu sync.Mutex
+	var received [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, strings.Split(string(body), "\n"))
+		mu.Unlock()
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	t.Cleanup(server.Close)
+	spool := t.TempDir()
+	setFlags(t, map[string]string{"upload-mode": "replace", "upload-spool": spool, "upload-retries": "2"})
+	spooled := func() []string {
+		files, _ := filepath.Glob(filepath.Join(spool, "upload_*.json"))
+		return files
+	}
+
+	// 401 不重试，也不保存到待重传目录
+	if err := sendUpload([]string{"1.1.1.1:443#香港"}, server.URL, "bad"); !errors.Is(err, errUploadRejected) {
+		t.Fatalf("401 应返回 errUploadRejected，得到 %v", err)
+	}
+	mu.Lock()
+	requests := len(received)
+	mu.Unlock()
+	if requests != 1 || len(spooled()) != 0 {
+		t.Fatalf("收到 %d 个请求，保存了 %d 个待重传文件，期望 1 个请求且不保存", requests, len(spooled()))
+	}
+
+	// 之前保存的数据重传时被拒绝，删除待重传文件，本次数据照常上传
+	if _, err := saveSpool(server.URL, "replace", []string{"1.1.1.2:443#东京"}); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	sendUpload([]string{"1.1.1.3:443#新加坡"}, server.URL, "bad")
+	if files := spooled(); len(files) != 0 {
+		t.Errorf("重传被拒绝后仍保留待重传文件 %v", files)
+	}
+
+	// 之后的上传不再重传被拒绝的数据
+	atomic.StoreInt32(&status, http.StatusOK)
+	mu.Lock()
+	received = nil
+	mu.Unlock()
+	if err := sendUpload([]string{"1.1.1.4:443#洛杉矶"}, server.URL, "good"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0][0] != "1.1.1.4:443#洛杉矶" {
+		t.Errorf("服务端收到 %q，期望只有本次的数据", received)
+	}
+}